@@ -0,0 +1,176 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AuthBasic authenticates against OBS with the user and the password.
+	AuthBasic = "basic"
+
+	// AuthToken authenticates against OBS with an API token.
+	AuthToken = "token"
+
+	// AuthSignature authenticates against OBS by signing a challenge with an
+	// SSH key registered for the user.
+	AuthSignature = "signature"
+)
+
+// AuthConfig contains the authentication method for OBS.
+type AuthConfig struct {
+	Type   string `yaml:"type"`
+	Token  string `yaml:"token"`
+	SSHKey string `yaml:"ssh_key"`
+}
+
+// merge returns the authentication method resulting of overriding the values
+// of this one with the ones given.
+func (auth AuthConfig) merge(other AuthConfig) AuthConfig {
+	if other.Type != "" {
+		auth.Type = other.Type
+	}
+	if other.Token != "" {
+		auth.Token = other.Token
+	}
+	if other.SSHKey != "" {
+		auth.SSHKey = other.SSHKey
+	}
+	return auth
+}
+
+// validate returns an error if the authentication method cannot be used with
+// the given user.
+func (auth AuthConfig) validate(user string) error {
+	switch auth.Type {
+	case "", AuthBasic:
+	case AuthToken:
+		if auth.Token == "" {
+			return fmt.Errorf("the token authentication requires an OBS token")
+		}
+	case AuthSignature:
+		if auth.SSHKey == "" {
+			return fmt.Errorf("the signature authentication requires an SSH key")
+		}
+		if user == "" {
+			return fmt.Errorf("the signature authentication requires a user")
+		}
+	default:
+		return fmt.Errorf("unknown authentication method '%v'", auth.Type)
+	}
+	return nil
+}
+
+// sshSign signs the given data with the given SSH key for the given namespace,
+// and returns the armored signature. It is a variable so tests can stub it.
+var sshSign = func(key, namespace string, data []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("ssh-keygen", "-Y", "sign", "-f", key, "-n", namespace, "-q")
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("could not sign with '%v': %v: %v", key, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// signatureRealms contains the realm of the signature challenge issued by
+// each OBS server, so requests after the first one can be signed right away.
+var signatureRealms = struct {
+	sync.Mutex
+	realms map[string]string
+}{realms: make(map[string]string)}
+
+// challengeRealm matches the realm of the challenge from the
+// `WWW-Authenticate` header.
+var challengeRealm = regexp.MustCompile(`realm="([^"]*)"`)
+
+// signatureChallenge returns the realm of the signature challenge of the given
+// response, if any.
+func signatureChallenge(resp *http.Response) (string, bool) {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return "", false
+	}
+	for _, value := range resp.Header["Www-Authenticate"] {
+		if !strings.HasPrefix(strings.ToLower(value), "signature ") {
+			continue
+		}
+		if m := challengeRealm.FindStringSubmatch(value); m != nil {
+			return m[1], true
+		}
+	}
+	return "", false
+}
+
+// authenticate sets the credentials for the given server into the given
+// request. With the signature method, requests are only signed if the
+// challenge from the server is already known.
+func authenticate(srv OBSServer, req *http.Request) error {
+	switch srv.Auth.Type {
+	case AuthToken:
+		req.Header.Set("Authorization", "Token "+srv.Auth.Token)
+	case AuthSignature:
+		signatureRealms.Lock()
+		realm, ok := signatureRealms.realms[srv.URL]
+		signatureRealms.Unlock()
+		if !ok {
+			return nil
+		}
+		header, err := signatureHeader(srv, realm, time.Now())
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", header)
+	default:
+		req.SetBasicAuth(srv.User, srv.Password)
+	}
+	return nil
+}
+
+// signatureHeader returns the value of the `Authorization` header that answers
+// the signature challenge of the given realm. As done by osc, the creation
+// time of the signature is signed with the SSH key of the user.
+func signatureHeader(srv OBSServer, realm string, created time.Time) (string, error) {
+	data := fmt.Sprintf("(created): %d", created.Unix())
+	armored, err := sshSign(srv.Auth.SSHKey, realm, []byte(data))
+	if err != nil {
+		return "", err
+	}
+
+	signature := ""
+	for _, line := range strings.Split(string(armored), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "-----") {
+			signature += line
+		}
+	}
+	if signature == "" {
+		return "", fmt.Errorf("empty signature from '%v'", srv.Auth.SSHKey)
+	}
+
+	return fmt.Sprintf(`Signature keyId="%v",algorithm="ssh",headers="(created)",created=%d,signature="%v"`,
+		srv.User, created.Unix(), signature), nil
+}
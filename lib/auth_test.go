@@ -0,0 +1,210 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testRealm = "Use your developer account"
+
+// testAuthOBS returns a fake OBS server which only accepts requests that pass
+// the given check. Accepted requests are handled as in testOBS. Otherwise the
+// signature challenge is issued. It also returns the number of challenges.
+func testAuthOBS(check func(r *http.Request) bool) (*httptest.Server, func() int) {
+	var mutex sync.Mutex
+	challenges := 0
+	obs := testOBS(&testOptions{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !check(r) {
+			mutex.Lock()
+			challenges++
+			mutex.Unlock()
+
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Signature realm="%v",headers="(created)"`, testRealm))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.SetBasicAuth("user", "password")
+		obs.Config.Handler.ServeHTTP(w, r)
+	}))
+	return server, func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return challenges
+	}
+}
+
+var signatureHeaderRegexp = regexp.MustCompile(
+	`^Signature keyId="user",algorithm="ssh",headers="\(created\)",created=(\d+),signature="U1NIU0lH"$`)
+
+// stubSSHSign replaces the signing of challenges with a fake one, and returns
+// a function that restores it.
+func stubSSHSign() func() {
+	original := sshSign
+	sshSign = func(key, namespace string, data []byte) ([]byte, error) {
+		if key != "/path/to/id_ed25519" || namespace != testRealm {
+			return nil, fmt.Errorf("wrong key '%v' or namespace '%v'", key, namespace)
+		}
+		if !strings.HasPrefix(string(data), "(created): ") {
+			return nil, fmt.Errorf("wrong data '%v'", string(data))
+		}
+		return []byte("-----BEGIN SSH SIGNATURE-----\nU1NI\nU0lH\n-----END SSH SIGNATURE-----\n"), nil
+	}
+	return func() { sshSign = original }
+}
+
+func TestAuthToken(t *testing.T) {
+	server, _ := testAuthOBS(func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Token my-token"
+	})
+	defer server.Close()
+
+	res := fetchRevision(context.Background(), &Configuration{
+		Server: server.URL,
+		Auth:   AuthConfig{Type: AuthToken, Token: "my-token"},
+	}, Listener{})
+	assertString(t, "1234", res)
+}
+
+func TestAuthSignature(t *testing.T) {
+	defer stubSSHSign()()
+
+	server, challenges := testAuthOBS(func(r *http.Request) bool {
+		return signatureHeaderRegexp.MatchString(r.Header.Get("Authorization"))
+	})
+	defer server.Close()
+
+	cfg := &Configuration{
+		Server: server.URL,
+		User:   "user",
+		Auth:   AuthConfig{Type: AuthSignature, SSHKey: "/path/to/id_ed25519"},
+	}
+	if !statusSucceeded(context.Background(), cfg, Listener{}) {
+		t.Fatalf("Expecting to be OK")
+	}
+	assertString(t, "1234", fetchRevision(context.Background(), cfg, Listener{}))
+
+	// The challenge is remembered, so only the first request gets it.
+	if challenges() != 1 {
+		t.Fatalf("Expecting one challenge, got %v", challenges())
+	}
+}
+
+func TestAuthSignatureFails(t *testing.T) {
+	original := sshSign
+	sshSign = func(key, namespace string, data []byte) ([]byte, error) {
+		return nil, fmt.Errorf("no such key")
+	}
+	defer func() { sshSign = original }()
+
+	server, _ := testAuthOBS(func(r *http.Request) bool { return false })
+	defer server.Close()
+
+	_, err := request(context.Background(), &Configuration{
+		Server: server.URL,
+		User:   "user",
+		Auth:   AuthConfig{Type: AuthSignature, SSHKey: "/path/to/id_ed25519"},
+	}, Listener{}, "GET", "/build/_status")
+	if err == nil || err.Error() != "no such key" {
+		t.Fatalf("Wrong error: %v", err)
+	}
+}
+
+func TestSignatureHeader(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not available")
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	key := filepath.Join(dir, "id_ed25519")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", key).CombinedOutput(); err != nil {
+		t.Skipf("Could not generate a key: %v", string(out))
+	}
+
+	srv := OBSServer{User: "user", Auth: AuthConfig{Type: AuthSignature, SSHKey: key}}
+	header, err := signatureHeader(srv, testRealm, time.Unix(1500000000, 0))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	exp := regexp.MustCompile(`^Signature keyId="user",algorithm="ssh",headers="\(created\)",created=1500000000,signature="[A-Za-z0-9+/=]+"$`)
+	if !exp.MatchString(header) {
+		t.Fatalf("Wrong header: %v", header)
+	}
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	for _, c := range []struct {
+		auth AuthConfig
+		user string
+		err  string
+	}{
+		{AuthConfig{}, "", ""},
+		{AuthConfig{Type: AuthBasic}, "user", ""},
+		{AuthConfig{Type: AuthToken, Token: "token"}, "", ""},
+		{AuthConfig{Type: AuthToken}, "", "the token authentication requires an OBS token"},
+		{AuthConfig{Type: AuthSignature, SSHKey: "key"}, "user", ""},
+		{AuthConfig{Type: AuthSignature}, "user", "the signature authentication requires an SSH key"},
+		{AuthConfig{Type: AuthSignature, SSHKey: "key"}, "", "the signature authentication requires a user"},
+		{AuthConfig{Type: "kerberos"}, "user", "unknown authentication method 'kerberos'"},
+	} {
+		err := c.auth.validate(c.user)
+		if c.err == "" && err != nil {
+			t.Fatalf("Expecting no errors for %v, got: %v", c.auth, err)
+		} else if c.err != "" && (err == nil || err.Error() != c.err) {
+			t.Fatalf("Expecting '%v' for %v, got: %v", c.err, c.auth, err)
+		}
+	}
+}
+
+func TestParseConfigurationAuth(t *testing.T) {
+	cfg, err := ParseConfiguration(
+		getPath("test/auth.yml"),
+		Credentials{Server: "https://api.opensuse.org", User: "user"},
+		Options{},
+	)
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, AuthSignature, cfg.Auth.Type)
+	assertString(t, "/path/to/id_ed25519", cfg.Auth.SSHKey)
+
+	// Flags take precedence over the configuration file.
+	cfg, err = ParseConfiguration(
+		getPath("test/auth.yml"),
+		Credentials{Server: "https://api.opensuse.org", Auth: AuthConfig{Type: AuthToken, Token: "token"}},
+		Options{},
+	)
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, AuthToken, cfg.Auth.Type)
+	assertString(t, "token", cfg.Auth.Token)
+}
@@ -0,0 +1,162 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultCommandTimeout is the maximum time that a command is allowed to run
+// if the trigger does not specify it.
+const defaultCommandTimeout = 10 * time.Minute
+
+// commandWaitDelay is how long to wait for the output of a command to be
+// closed after it has been killed. It covers processes that escaped its
+// process group.
+const commandWaitDelay = 5 * time.Second
+
+// commandTrigger runs a local command for each tag.
+type commandTrigger struct {
+	command string
+	args    []string
+	env     map[string]string
+	timeout time.Duration
+}
+
+// newCommandTrigger returns a command trigger for the given listener.
+func newCommandTrigger(cfg *Configuration, list Listener, tc TriggerConfig) (Trigger, error) {
+	opts := struct {
+		Command string            `yaml:"command"`
+		Args    []string          `yaml:"args"`
+		Env     map[string]string `yaml:"env"`
+		Timeout time.Duration     `yaml:"timeout"`
+	}{}
+	if err := tc.decode(&opts); err != nil {
+		return nil, fmt.Errorf("%v service: %v", list.Name, err)
+	}
+
+	if opts.Command == "" {
+		return nil, fmt.Errorf("%v service does not provide a command!", list.Name)
+	}
+	if opts.Timeout < 0 {
+		return nil, fmt.Errorf("%v service has a negative command timeout!", list.Name)
+	} else if opts.Timeout == 0 {
+		opts.Timeout = defaultCommandTimeout
+	}
+
+	return &commandTrigger{
+		command: opts.Command,
+		args:    opts.Args,
+		env:     opts.Env,
+		timeout: opts.Timeout,
+	}, nil
+}
+
+// environment returns the environment of the command for the given tag. On
+// top of the environment of openhub, the configured variables and the data of
+// the event as `OPENHUB_*` variables are set.
+func (t *commandTrigger) environment(ev Event, tag string) []string {
+	vars := eventVariables(ev, tag)
+	vars["OPENHUB_TAGS"] = strings.Join(ev.Tags, ",")
+	for k, v := range t.env {
+		if _, ok := vars[k]; !ok {
+			vars[k] = v
+		}
+	}
+
+	keys := []string{}
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	env := os.Environ()
+	for _, k := range keys {
+		env = append(env, k+"="+vars[k])
+	}
+	return env
+}
+
+// run runs the command for the given tag. Its output is logged line by line.
+func (t *commandTrigger) run(ctx context.Context, ev Event, tag string) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.command, t.args...)
+	cmd.Env = t.environment(ev, tag)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = commandWaitDelay
+	setProcessGroup(cmd)
+
+	err := cmd.Run()
+	logOutput(ev.Name, "stdout", &stdout)
+	logOutput(ev.Name, "stderr", &stderr)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("command '%v' for tag '%v' timed out after %v", t.command, tag, t.timeout)
+	} else if err != nil {
+		return fmt.Errorf("command '%v' for tag '%v' failed: %v", t.command, tag, err)
+	}
+	return nil
+}
+
+// logOutput logs each line of the given output of a command.
+func logOutput(name, stream string, output *bytes.Buffer) {
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		log.Printf("%v: %v: %v", name, stream, scanner.Text())
+	}
+}
+
+// Fire implements the Trigger interface.
+func (t *commandTrigger) Fire(ctx context.Context, ev Event) error {
+	for _, tag := range ev.Tags {
+		if err := t.run(ctx, ev, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describe implements the Trigger interface. The values of the configured
+// environment variables are not shown since they might contain secrets.
+func (t *commandTrigger) Describe(ev Event) []string {
+	res := []string{}
+	for _, tag := range ev.Tags {
+		res = append(res, fmt.Sprintf("run '%v' with OPENHUB_TAG=%v", t.commandLine(), tag))
+	}
+	return res
+}
+
+// commandLine returns the command with its arguments.
+func (t *commandTrigger) commandLine() string {
+	return strings.TrimSpace(t.command + " " + strings.Join(t.args, " "))
+}
+
+func (t *commandTrigger) String() string {
+	return "command '" + t.commandLine() + "'"
+}
@@ -0,0 +1,174 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func commandConfig(options map[string]interface{}) TriggerConfig {
+	return triggerConfig("command", nil, options)
+}
+
+func TestCommandFire(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	script := `echo "$OPENHUB_NAME $OPENHUB_PROJECT $OPENHUB_PACKAGE $OPENHUB_DISTRIBUTION ` +
+		`$OPENHUB_ARCHITECTURE $OPENHUB_REVISION $OPENHUB_TAG $OPENHUB_TAGS $IMAGE"; echo oops >&2`
+	trigger, err := newCommandTrigger(&Configuration{}, Listener{Name: "portus-head"}, commandConfig(map[string]interface{}{
+		"command": "sh",
+		"args":    []interface{}{"-c", script},
+		"env":     map[interface{}]interface{}{"IMAGE": "portus", "OPENHUB_TAG": "ignored"},
+	}))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := trigger.Fire(context.Background(), testEvent); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	logged := buf.String()
+	for _, tag := range testEvent.Tags {
+		msg := "portus-head: stdout: portus-head Virtualization:containers:Portus portus " +
+			"openSUSE_Leap_42.3 x86_64 1234 " + tag + " head,latest portus"
+		if !strings.Contains(logged, msg) {
+			t.Fatalf("Wrong log: %v", logged)
+		}
+	}
+	if strings.Count(logged, "portus-head: stderr: oops") != 2 {
+		t.Fatalf("Wrong log: %v", logged)
+	}
+}
+
+func TestCommandFails(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	trigger, err := newCommandTrigger(&Configuration{}, Listener{Name: "portus-head"}, commandConfig(map[string]interface{}{
+		"command": "sh",
+		"args":    []interface{}{"-c", `echo "$OPENHUB_TAG"; exit 3`},
+	}))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	err = trigger.Fire(context.Background(), testEvent)
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "command 'sh' for tag 'head' failed: exit status 3", err.Error())
+	if strings.Contains(buf.String(), "latest") {
+		t.Fatalf("Expecting to stop on the first failure")
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	trigger, err := newCommandTrigger(&Configuration{}, Listener{Name: "portus-head"}, commandConfig(map[string]interface{}{
+		"command": "sleep",
+		"args":    []interface{}{"10"},
+		"timeout": "50ms",
+	}))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	start := time.Now()
+	err = trigger.Fire(context.Background(), testEvent)
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "command 'sleep' for tag 'head' timed out after 50ms", err.Error())
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Expecting the command to be killed")
+	}
+}
+
+func TestCommandTimeoutChildren(t *testing.T) {
+	trigger, err := newCommandTrigger(&Configuration{}, Listener{Name: "portus-head"}, commandConfig(map[string]interface{}{
+		"command": "sh",
+		"args":    []interface{}{"-c", "sleep 10; echo done"},
+		"timeout": "100ms",
+	}))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	// The forked sleep is killed along with the shell, so its output does
+	// not keep the trigger waiting.
+	start := time.Now()
+	err = trigger.Fire(context.Background(), testEvent)
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "command 'sh' for tag 'head' timed out after 100ms", err.Error())
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expecting the command and its children to be killed, took %v", elapsed)
+	}
+}
+
+func TestCommandDescribe(t *testing.T) {
+	tc := commandConfig(map[string]interface{}{
+		"command": "/usr/local/bin/build",
+		"args":    []interface{}{"--push"},
+		"env":     map[interface{}]interface{}{"PASSWORD": "secret"},
+	})
+	trigger := testTriggerDescribe(t, newCommandTrigger, Listener{Name: "portus-head"}, tc, testEvent, []string{
+		"run '/usr/local/bin/build --push' with OPENHUB_TAG=head",
+		"run '/usr/local/bin/build --push' with OPENHUB_TAG=latest",
+	})
+	assertString(t, "command '/usr/local/bin/build --push'", trigger.String())
+}
+
+func TestCommandBadConfiguration(t *testing.T) {
+	testBadTriggerConfiguration(t, newCommandTrigger, Listener{Name: "portus-head"}, "command", nil, []badTriggerConfiguration{
+		{nil, "portus-head service does not provide a command!"},
+		{map[string]interface{}{"command": "true", "timeout": "-1s"}, "portus-head service has a negative command timeout!"},
+	})
+}
+
+func TestSyncCommandFailureKeepsRevision(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+
+	cfg := testShutdownConfiguration(obs.URL, 0)
+	cfg.Listeners[0].Trigger = commandConfig(map[string]interface{}{"command": "false"})
+	st := &state{
+		revisions: map[string]string{"portus-2.3": "1000"},
+		store:     &memoryStore{},
+		seen:      make(map[string]bool),
+		triggers:  context.Background(),
+	}
+	synchronize(context.Background(), cfg, cfg.Listeners[0], st)
+
+	if rev, _ := st.revision("portus-2.3"); rev != "1000" {
+		t.Fatalf("Expecting the revision not to be advanced, got '%v'", rev)
+	}
+	if !strings.Contains(buf.String(), "portus-2.3: command 'false' for tag '2.3' failed: exit status 1") {
+		t.Fatalf("Wrong log")
+	}
+}
@@ -19,7 +19,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -32,6 +37,30 @@ const (
 	// defaultArchitecture will be picked if the configuration does not specify
 	// one.
 	defaultArchitecutre = "x86_64"
+
+	// defaultInterval will be picked if neither the flags nor the
+	// configuration specify how often services have to be checked.
+	defaultInterval = 5 * time.Minute
+
+	// defaultWorkers is the maximum number of listeners being synchronized at
+	// the same time if neither the flags nor the configuration specify it.
+	defaultWorkers = 8
+)
+
+const (
+	// InitialTrigger is the initial policy in which listeners without a
+	// persisted revision trigger their tags right away.
+	InitialTrigger = "trigger"
+
+	// InitialRecordOnly is the initial policy in which the first revision
+	// seen for a listener without a persisted revision is recorded as the
+	// baseline, without triggering anything.
+	InitialRecordOnly = "record-only"
+
+	// InitialTriggerIfNewer is the initial policy in which tags are only
+	// triggered if the first revision seen is newer than the persisted one.
+	// Otherwise it is recorded as the baseline.
+	InitialTriggerIfNewer = "trigger-if-newer-than-state"
 )
 
 // Credentials is a helper struct that you can use to pass credential options to
@@ -41,72 +70,226 @@ type Credentials struct {
 	User     string
 	Password string
 	Token    string
+
+	// Auth is the authentication method for OBS. Its values take precedence
+	// over the ones from the configuration file.
+	Auth AuthConfig
+
+	// Oscrc is the path to an osc configuration file from which the user and
+	// the password for the server are read, unless they were given.
+	Oscrc string
 }
 
 // Options contain some extra options that may be given to the `ParseConfiguration`.
 type Options struct {
-	SingleShot bool
+	SingleShot  bool
+	DryRun      bool
+	Interval    time.Duration
+	Workers     int
+	GracePeriod time.Duration
+	StatePath   string
+	StateFormat string
 }
 
 // Configuration holds all the data relevant for this application to perform
 // properly.
 type Configuration struct {
-	Server     string
-	User       string
-	Password   string
-	Token      string
-	SingleShot bool
-	Listeners  []Listener
+	Server      string
+	User        string
+	Password    string
+	Token       string
+	SingleShot  bool
+	DryRun      bool
+	StatePath   string
+	StateFormat string
+	Interval    time.Duration
+	Workers     int
+	GracePeriod time.Duration
+	Retry       RetryPolicy
+	Auth        AuthConfig
+	Listeners   []Listener
+
+	// Tokens contains the trigger token of each repository. It takes
+	// precedence over the global token.
+	Tokens map[string]string
+
+	// Servers contains the OBS instances that can be referenced by listeners
+	// besides the global one.
+	Servers map[string]OBSServer
+
+	// TLS and Proxy configure the connections to the global server.
+	TLS   TLSConfig
+	Proxy string
+
+	// Triggers configures the connections of the rest of requests.
+	Triggers TriggersConfig
+
+	// HTTP configures the pool of connections of each endpoint.
+	HTTP HTTPConfig
+
+	// obsClient is shared by all the requests to the global server, and
+	// client by the rest of requests (e.g. triggers).
+	obsClient *http.Client
+	client    *http.Client
 }
 
 // Listener holds all the data relevant for services. That is, the OBS data and
 // the Docker tags that relate to it.
 type Listener struct {
 	Name         string
-	Project      string   `yaml:"project"`
-	Distribution string   `yaml:"distribution"`
-	Architecture string   `yaml:"architecture"`
-	Package      string   `yaml:"package"`
-	Repository   string   `yaml:"repository"`
-	Tags         []string `yaml:"tags"`
+	Server       string        `yaml:"server"`
+	Project      string        `yaml:"project"`
+	Distribution string        `yaml:"distribution"`
+	Architecture string        `yaml:"architecture"`
+	Package      string        `yaml:"package"`
+	Repository   string        `yaml:"repository"`
+	Tags         []string      `yaml:"tags"`
+	Interval     time.Duration `yaml:"interval"`
+	Initial      string        `yaml:"initial"`
+
+	// Token is the trigger token for this service. It takes precedence over
+	// the token of its repository and the global one.
+	Token string `yaml:"token"`
+
+	// WaitPublished tells whether triggers have to wait until OBS has
+	// published the repository. If not set, the global value is used.
+	WaitPublished *bool `yaml:"wait_published"`
+
+	// VerifyRepoURL is the URL of the rpm-md repository in which the package
+	// has to be available before triggering anything.
+	VerifyRepoURL string `yaml:"verify_repo_url"`
+
+	// Trigger is the configuration of the backend to be triggered on new
+	// revisions. If no type is given, Docker Hub is assumed.
+	Trigger TriggerConfig `yaml:"trigger"`
+
+	// trigger is the backend built from the configuration above.
+	trigger Trigger
 }
 
 // ConfigFile is the struct to be used when parsing the configuration.
 type ConfigFile struct {
-	Services map[string]Listener `yaml:"services,omitempty"`
+	Interval      time.Duration        `yaml:"interval,omitempty"`
+	Workers       int                  `yaml:"workers,omitempty"`
+	Retry         RetryPolicy          `yaml:"retry,omitempty"`
+	Initial       string               `yaml:"initial,omitempty"`
+	WaitPublished bool                 `yaml:"wait_published,omitempty"`
+	Tokens        map[string]string    `yaml:"tokens,omitempty"`
+	Auth          AuthConfig           `yaml:"auth,omitempty"`
+	Servers       map[string]OBSServer `yaml:"servers,omitempty"`
+	TLS           TLSConfig            `yaml:"tls,omitempty"`
+	Proxy         string               `yaml:"proxy,omitempty"`
+	Triggers      TriggersConfig       `yaml:"triggers,omitempty"`
+	HTTP          HTTPConfig           `yaml:"http,omitempty"`
+	Services      map[string]Listener  `yaml:"services,omitempty"`
 }
 
 // ParseConfiguration returns a proper Configuration object by taking into
 // account the given flags and the configuration file.
 func ParseConfiguration(path string, crd Credentials, opts Options) (*Configuration, error) {
-	listeners, err := parseConfiguration(path)
+	settings, err := parseConfiguration(path)
 	if err != nil {
 		return nil, err
 	}
+	if err := settings.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	if crd, err = crd.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	if crd, err = crd.fromOscrc(); err != nil {
+		return nil, err
+	}
+	switch opts.StateFormat {
+	case "", JSONStore, KVStore:
+	default:
+		return nil, fmt.Errorf("unknown state format '%v'", opts.StateFormat)
+	}
 
-	return &Configuration{
-		Server:     crd.Server,
-		User:       crd.User,
-		Password:   crd.Password,
-		Token:      crd.Token,
-		SingleShot: opts.SingleShot,
-		Listeners:  listeners,
-	}, nil
-}
+	cfg := &Configuration{
+		Server:      crd.Server,
+		User:        crd.User,
+		Password:    crd.Password,
+		Token:       crd.Token,
+		SingleShot:  opts.SingleShot,
+		DryRun:      opts.DryRun,
+		StatePath:   opts.StatePath,
+		StateFormat: opts.StateFormat,
+		Interval:    globalInterval(opts, settings),
+		Workers:     globalWorkers(opts, settings),
+		GracePeriod: opts.GracePeriod,
+		Retry:       settings.Retry,
+		Tokens:      settings.Tokens,
+		Auth:        settings.Auth.merge(crd.Auth),
+		TLS:         settings.TLS,
+		Proxy:       settings.Proxy,
+		Triggers:    settings.Triggers,
+		HTTP:        settings.HTTP,
+	}
+	if cfg.Interval < 0 {
+		return nil, fmt.Errorf("the given interval cannot be negative")
+	}
+	if cfg.Workers < 0 {
+		return nil, fmt.Errorf("the given number of workers cannot be negative")
+	}
+	if err := cfg.Retry.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Auth.validate(cfg.User); err != nil {
+		return nil, err
+	}
+	if err := cfg.HTTP.validate(); err != nil {
+		return nil, err
+	}
+	transport, err := newTransport(cfg.TLS, cfg.Proxy, cfg.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	cfg.obsClient = newClient(requestTimeout, transport)
+	if transport, err = newTransport(cfg.Triggers.TLS, cfg.Triggers.Proxy, cfg.HTTP); err != nil {
+		return nil, fmt.Errorf("triggers: %v", err)
+	}
+	cfg.client = newClient(requestTimeout, transport)
+	if cfg.Servers, err = sanitizeServers(settings, crd); err != nil {
+		return nil, err
+	}
+	if settings.Initial == "" {
+		settings.Initial = InitialTrigger
+	} else if !validInitial(settings.Initial) {
+		return nil, fmt.Errorf("unknown initial policy '%v'", settings.Initial)
+	}
 
-// parseConfiguration returns a list of listeners by taking into account the
-// configuration file.
-func parseConfiguration(configurationPath string) ([]Listener, error) {
-	data, err := readConfigFile(configurationPath)
+	cfg.Listeners, err = sanitizeListeners(settings, cfg)
 	if err != nil {
 		return nil, err
 	}
+	return cfg, nil
+}
 
+// parseConfiguration returns the parsed contents of the given configuration
+// file.
+func parseConfiguration(configurationPath string) (ConfigFile, error) {
 	settings := ConfigFile{}
-	if err = yaml.Unmarshal([]byte(data), &settings); err != nil {
-		return nil, err
+
+	data, err := readConfigFile(configurationPath)
+	if err != nil {
+		return settings, err
+	}
+	err = yaml.Unmarshal([]byte(data), &settings)
+	return settings, err
+}
+
+// globalInterval returns the default interval for all listeners. The interval
+// given through the options takes precedence over the one from the
+// configuration file.
+func globalInterval(opts Options, settings ConfigFile) time.Duration {
+	if opts.Interval != 0 {
+		return opts.Interval
+	}
+	if settings.Interval != 0 {
+		return settings.Interval
 	}
-	return sanitizeListeners(settings)
+	return defaultInterval
 }
 
 // readConfigFile returns the contents from the configuration file.
@@ -115,21 +298,43 @@ func readConfigFile(configurationPath string) ([]byte, error) {
 	return ioutil.ReadFile(path)
 }
 
+// globalWorkers returns the maximum number of listeners to be synchronized at
+// the same time. The value given through the options takes precedence over the
+// one from the configuration file.
+func globalWorkers(opts Options, settings ConfigFile) int {
+	if opts.Workers != 0 {
+		return opts.Workers
+	}
+	if settings.Workers != 0 {
+		return settings.Workers
+	}
+	return defaultWorkers
+}
+
+// validInitial returns true if the given initial policy is known.
+func validInitial(initial string) bool {
+	switch initial {
+	case InitialTrigger, InitialRecordOnly, InitialTriggerIfNewer:
+		return true
+	}
+	return false
+}
+
 // sanitizeListeners iterates over the parsed services and sanitizes their
-// contents.
-func sanitizeListeners(settings ConfigFile) ([]Listener, error) {
+// contents. Global defaults are picked from the given configuration.
+func sanitizeListeners(settings ConfigFile, cfg *Configuration) ([]Listener, error) {
 	listeners := []Listener{}
 
 	for name, list := range settings.Services {
 		if list.Project == "" {
 			return nil, fmt.Errorf("%v service does not provide a project!", name)
 		}
+		if _, ok := cfg.Servers[list.Server]; list.Server != "" && !ok {
+			return nil, fmt.Errorf("%v service references an unknown server '%v'!", name, list.Server)
+		}
 		if list.Package == "" {
 			return nil, fmt.Errorf("%v service does not provide a package!", name)
 		}
-		if list.Repository == "" {
-			return nil, fmt.Errorf("%v service does not provide a repository!", name)
-		}
 		if len(list.Tags) == 0 {
 			return nil, fmt.Errorf("%v service does not provide tags!", name)
 		}
@@ -143,9 +348,106 @@ func sanitizeListeners(settings ConfigFile) ([]Listener, error) {
 			log.Printf("%v service does not provide an architecture, assuming %v",
 				name, defaultArchitecutre)
 		}
+		if list.Initial == "" {
+			list.Initial = settings.Initial
+		} else if !validInitial(list.Initial) {
+			return nil, fmt.Errorf("%v service has an unknown initial policy '%v'!", name, list.Initial)
+		}
+		if list.WaitPublished == nil {
+			wait := settings.WaitPublished
+			list.WaitPublished = &wait
+		}
+		if list.Interval < 0 {
+			return nil, fmt.Errorf("%v service has a negative interval!", name)
+		} else if list.Interval == 0 {
+			list.Interval = cfg.Interval
+		}
 		list.Name = name
 
+		trigger, err := newTrigger(cfg, list)
+		if err != nil {
+			return nil, err
+		}
+		list.trigger = trigger
+
 		listeners = append(listeners, list)
 	}
 	return listeners, nil
 }
+
+// listenersDiff contains the differences between two sets of listeners.
+type listenersDiff struct {
+	added   map[string]bool
+	removed []string
+	changed map[string]bool
+
+	// moved contains the changed listeners that now point to a different
+	// package (i.e. their identity changed).
+	moved map[string]bool
+}
+
+// diffListeners returns the differences between the old and the new set of
+// listeners.
+func diffListeners(old, listeners []Listener) listenersDiff {
+	diff := listenersDiff{
+		added:   make(map[string]bool),
+		changed: make(map[string]bool),
+		moved:   make(map[string]bool),
+	}
+
+	previous := make(map[string]Listener)
+	for _, list := range old {
+		previous[list.Name] = list
+	}
+
+	for _, list := range listeners {
+		prev, ok := previous[list.Name]
+		delete(previous, list.Name)
+
+		if !ok {
+			diff.added[list.Name] = true
+		} else if !equalListeners(prev, list) {
+			diff.changed[list.Name] = true
+			if prev.identity() != list.identity() {
+				diff.moved[list.Name] = true
+			}
+		}
+	}
+
+	for name := range previous {
+		diff.removed = append(diff.removed, name)
+	}
+	sort.Strings(diff.removed)
+	return diff
+}
+
+// serviceToken returns the trigger token for the given listener and
+// repository: either the token of the service or the one of the repository.
+// An empty string is returned if neither was given.
+func serviceToken(cfg *Configuration, list Listener, repository string) string {
+	if list.Token != "" {
+		return list.Token
+	}
+	return cfg.Tokens[repository]
+}
+
+// equalListeners returns true if both listeners have the same configuration.
+// The triggers built from it are not compared, since they may hold state.
+func equalListeners(a, b Listener) bool {
+	a.trigger, b.trigger = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// waitsForPublish returns true if triggers for this listener have to wait
+// until OBS has published its repository.
+func (list Listener) waitsForPublish() bool {
+	return list.WaitPublished != nil && *list.WaitPublished
+}
+
+// identity returns a string that identifies the package being followed by
+// this listener.
+func (list Listener) identity() string {
+	return strings.Join([]string{
+		list.Server, list.Project, list.Distribution, list.Architecture, list.Package,
+	}, "/")
+}
@@ -23,6 +23,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func getPath(subpath string) string {
@@ -247,3 +248,211 @@ func TestParseConfigurationNoTags(t *testing.T) {
 		t.Fatalf("Wrong error")
 	}
 }
+
+func TestParseConfigurationUnknownStateFormat(t *testing.T) {
+	_, err := ParseConfiguration(
+		getPath("test/noarchnodist.yml"),
+		Credentials{
+			Server:   "https://api.opensuse.org",
+			User:     "mssola",
+			Password: "password",
+			Token:    "token",
+		},
+		Options{SingleShot: true, StatePath: "/tmp/state", StateFormat: "xml"},
+	)
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	if !strings.Contains(err.Error(), "unknown state format 'xml'") {
+		t.Fatalf("Wrong error")
+	}
+}
+
+func TestParseConfigurationGlobals(t *testing.T) {
+	crd := Credentials{
+		Server:   "https://api.opensuse.org",
+		User:     "mssola",
+		Password: "password",
+		Token:    "token",
+	}
+
+	// Global interval from the configuration file.
+	cfg, err := ParseConfiguration(getPath("test/interval.yml"), crd, Options{})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if cfg.Interval != time.Hour {
+		t.Fatalf("Expecting a global interval of 1h, got %v", cfg.Interval)
+	}
+	if cfg.Workers != 2 {
+		t.Fatalf("Expecting 2 workers, got %v", cfg.Workers)
+	}
+	if list := findListener(t, cfg.Listeners, "portus-head"); list.Interval != time.Minute {
+		t.Fatalf("Expecting an interval of 1m, got %v", list.Interval)
+	}
+	if list := findListener(t, cfg.Listeners, "portus-2.3"); list.Interval != time.Hour {
+		t.Fatalf("Expecting an interval of 1h, got %v", list.Interval)
+	}
+
+	// The interval from the options takes precedence over the global one, but
+	// not over the one from the service.
+	cfg, err = ParseConfiguration(getPath("test/interval.yml"), crd, Options{Interval: 10 * time.Minute, Workers: 3})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if cfg.Workers != 3 {
+		t.Fatalf("Expecting 3 workers, got %v", cfg.Workers)
+	}
+	if list := findListener(t, cfg.Listeners, "portus-head"); list.Interval != time.Minute {
+		t.Fatalf("Expecting an interval of 1m, got %v", list.Interval)
+	}
+	if list := findListener(t, cfg.Listeners, "portus-2.3"); list.Interval != 10*time.Minute {
+		t.Fatalf("Expecting an interval of 10m, got %v", list.Interval)
+	}
+
+	// Default interval.
+	cfg, err = ParseConfiguration(getPath("test/noarchnodist.yml"), crd, Options{})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if cfg.Interval != defaultInterval {
+		t.Fatalf("Expecting the default interval, got %v", cfg.Interval)
+	}
+	if cfg.Workers != defaultWorkers {
+		t.Fatalf("Expecting the default number of workers, got %v", cfg.Workers)
+	}
+}
+
+func TestParseConfigurationNegativeInterval(t *testing.T) {
+	_, err := ParseConfiguration(
+		getPath("test/badinterval.yml"),
+		Credentials{Server: "https://api.opensuse.org"},
+		Options{},
+	)
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	if !strings.Contains(err.Error(), "has a negative interval!") {
+		t.Fatalf("Wrong error")
+	}
+}
+
+func TestDiffListeners(t *testing.T) {
+	old := []Listener{
+		{Name: "same", Project: "p", Package: "a", Tags: []string{"1"}},
+		{Name: "tags", Project: "p", Package: "b", Tags: []string{"1"}},
+		{Name: "moved", Project: "p", Package: "c", Tags: []string{"1"}},
+		{Name: "removed", Project: "p", Package: "d", Tags: []string{"1"}},
+	}
+	listeners := []Listener{
+		{Name: "same", Project: "p", Package: "a", Tags: []string{"1"}},
+		{Name: "tags", Project: "p", Package: "b", Tags: []string{"1", "2"}},
+		{Name: "moved", Project: "other", Package: "c", Tags: []string{"1"}},
+		{Name: "added", Project: "p", Package: "e", Tags: []string{"1"}},
+	}
+
+	diff := diffListeners(old, listeners)
+	if len(diff.added) != 1 || !diff.added["added"] {
+		t.Fatalf("Unexpected added listeners: %v", diff.added)
+	}
+	assertSlice(t, []string{"removed"}, diff.removed)
+	if len(diff.changed) != 2 || !diff.changed["tags"] || !diff.changed["moved"] {
+		t.Fatalf("Unexpected changed listeners: %v", diff.changed)
+	}
+	if len(diff.moved) != 1 || !diff.moved["moved"] {
+		t.Fatalf("Unexpected moved listeners: %v", diff.moved)
+	}
+}
+
+func TestParseConfigurationRetry(t *testing.T) {
+	cfg, err := ParseConfiguration(
+		getPath("test/retry.yml"),
+		Credentials{Server: "https://api.opensuse.org"},
+		Options{},
+	)
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	expected := RetryPolicy{Attempts: 5, Backoff: 2 * time.Second, MaxBackoff: 30 * time.Second}
+	if cfg.Retry != expected {
+		t.Fatalf("Unexpected retry policy: %#v", cfg.Retry)
+	}
+}
+
+func TestParseConfigurationInitial(t *testing.T) {
+	crd := Credentials{Server: "https://api.opensuse.org"}
+
+	cfg, err := ParseConfiguration(getPath("test/initial.yml"), crd, Options{})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, InitialTriggerIfNewer, findListener(t, cfg.Listeners, "portus-head").Initial)
+	assertString(t, InitialRecordOnly, findListener(t, cfg.Listeners, "portus-2.3").Initial)
+
+	cfg, err = ParseConfiguration(getPath("test/noarchnodist.yml"), crd, Options{})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, InitialTrigger, findListener(t, cfg.Listeners, "portus-head").Initial)
+}
+
+func TestParseConfigurationUnknownInitial(t *testing.T) {
+	_, err := ParseConfiguration(
+		getPath("test/badinitial.yml"),
+		Credentials{Server: "https://api.opensuse.org"},
+		Options{},
+	)
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	if !strings.Contains(err.Error(), "has an unknown initial policy 'whatever'!") {
+		t.Fatalf("Wrong error")
+	}
+}
+
+func TestParseConfigurationWaitPublished(t *testing.T) {
+	cfg, err := ParseConfiguration(
+		getPath("test/published.yml"),
+		Credentials{Server: "https://api.opensuse.org"},
+		Options{},
+	)
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if findListener(t, cfg.Listeners, "portus-head").waitsForPublish() {
+		t.Fatalf("portus-head should not wait for the repository to be published")
+	}
+	if !findListener(t, cfg.Listeners, "portus-2.3").waitsForPublish() {
+		t.Fatalf("portus-2.3 should wait for the repository to be published")
+	}
+}
+
+func TestParseConfigurationTokens(t *testing.T) {
+	cfg, err := ParseConfiguration(
+		getPath("test/tokens.yml"),
+		Credentials{Server: "https://api.opensuse.org", Token: "global-token"},
+		Options{},
+	)
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	for name, token := range map[string]string{
+		"portus-head": "head-token",
+		"portus-2.3":  "portus-token",
+		"registry":    "global-token",
+	} {
+		hub, ok := findListener(t, cfg.Listeners, name).trigger.(*dockerHubTrigger)
+		if !ok {
+			t.Fatalf("Expecting a Docker Hub trigger for %v", name)
+		}
+		assertString(t, token, hub.token)
+	}
+
+	quay, ok := findListener(t, cfg.Listeners, "registry-quay").trigger.(*quayTrigger)
+	if !ok {
+		t.Fatalf("Expecting a Quay trigger")
+	}
+	assertString(t, "registry-token", quay.token)
+}
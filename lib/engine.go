@@ -0,0 +1,341 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultEngineSocket is the default location of the socket of the Docker
+	// Engine.
+	defaultEngineSocket = "/var/run/docker.sock"
+
+	// defaultEngineTimeout is the maximum time to build and push an image if
+	// the trigger does not specify it.
+	defaultEngineTimeout = time.Hour
+
+	// defaultRevisionArg is the build argument which gets the OBS revision.
+	defaultRevisionArg = "OPENHUB_REVISION"
+)
+
+// engineTrigger builds and pushes images through the API of a Docker Engine
+// listening on a unix socket.
+type engineTrigger struct {
+	socket      string
+	context     string
+	dockerfile  string
+	image       string
+	buildArgs   map[string]string
+	revisionArg string
+	auth        registryAuth
+	timeout     time.Duration
+	client      *http.Client
+}
+
+// registryAuth contains the credentials used to push into a registry, as
+// expected by the Docker Engine API.
+type registryAuth struct {
+	Username      string `yaml:"username" json:"username,omitempty"`
+	Password      string `yaml:"password" json:"password,omitempty"`
+	ServerAddress string `yaml:"server" json:"serveraddress,omitempty"`
+}
+
+// newEngineTrigger returns a Docker Engine trigger for the given listener. The
+// image defaults to the repository of the listener.
+func newEngineTrigger(cfg *Configuration, list Listener, tc TriggerConfig) (Trigger, error) {
+	opts := struct {
+		Socket      string            `yaml:"socket"`
+		Context     string            `yaml:"context"`
+		Dockerfile  string            `yaml:"dockerfile"`
+		Image       string            `yaml:"image"`
+		BuildArgs   map[string]string `yaml:"build_args"`
+		RevisionArg string            `yaml:"revision_arg"`
+		Registry    registryAuth      `yaml:"registry"`
+		Timeout     time.Duration     `yaml:"timeout"`
+	}{}
+	if err := tc.decode(&opts); err != nil {
+		return nil, fmt.Errorf("%v service: %v", list.Name, err)
+	}
+
+	if opts.Socket == "" {
+		opts.Socket = defaultEngineSocket
+	}
+	if opts.Context == "" {
+		return nil, fmt.Errorf("%v service does not provide a build context!", list.Name)
+	}
+	if opts.Dockerfile == "" {
+		opts.Dockerfile = "Dockerfile"
+	}
+	if opts.Image == "" {
+		opts.Image = list.Repository
+	}
+	if opts.Image == "" {
+		return nil, fmt.Errorf("%v service does not provide an image!", list.Name)
+	}
+	if opts.RevisionArg == "" {
+		opts.RevisionArg = defaultRevisionArg
+	}
+	if opts.Timeout < 0 {
+		return nil, fmt.Errorf("%v service has a negative build timeout!", list.Name)
+	} else if opts.Timeout == 0 {
+		opts.Timeout = defaultEngineTimeout
+	}
+
+	socket := opts.Socket
+	transport := pooledTransport(cfg.HTTP)
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+
+	return &engineTrigger{
+		socket:      opts.Socket,
+		context:     opts.Context,
+		dockerfile:  opts.Dockerfile,
+		image:       opts.Image,
+		buildArgs:   opts.BuildArgs,
+		revisionArg: opts.RevisionArg,
+		auth:        opts.Registry,
+		timeout:     opts.Timeout,
+		client:      &http.Client{Transport: transport},
+	}, nil
+}
+
+// closeIdleConnections closes the idle connections to the Docker Engine.
+func (t *engineTrigger) closeIdleConnections() {
+	t.client.CloseIdleConnections()
+}
+
+// buildEndpoint returns the endpoint that builds the image for the given
+// event.
+func (t *engineTrigger) buildEndpoint(ev Event) (string, error) {
+	args := map[string]string{}
+	for k, v := range t.buildArgs {
+		args[k] = v
+	}
+	args[t.revisionArg] = ev.Revision
+
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	for _, tag := range ev.Tags {
+		query.Add("t", t.image+":"+tag)
+	}
+	query.Set("dockerfile", t.dockerfile)
+	query.Set("buildargs", string(encoded))
+	query.Set("rm", "1")
+	return "/build?" + query.Encode(), nil
+}
+
+// pushEndpoint returns the endpoint that pushes the given tag of the image.
+func (t *engineTrigger) pushEndpoint(tag string) string {
+	return "/images/" + t.image + "/push?" + url.Values{"tag": {tag}}.Encode()
+}
+
+// Fire implements the Trigger interface. The image is built once with all the
+// tags, and then each tag is pushed.
+func (t *engineTrigger) Fire(ctx context.Context, ev Event) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	if err := t.build(ctx, ev); err != nil {
+		return err
+	}
+	for _, tag := range ev.Tags {
+		if err := t.push(ctx, ev, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// build builds the image for the given event from the configured context.
+func (t *engineTrigger) build(ctx context.Context, ev Event) error {
+	endpoint, err := t.buildEndpoint(ev)
+	if err != nil {
+		return err
+	}
+
+	// The context is streamed so it is never fully kept in memory.
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(tarDirectory(writer, t.context))
+	}()
+	defer reader.Close()
+
+	req, err := http.NewRequest("POST", "http://docker"+endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+
+	if err := t.do(ctx, ev.Name, req); err != nil {
+		return fmt.Errorf("could not build '%v': %v", t.image, err)
+	}
+	return nil
+}
+
+// push pushes the given tag of the image into its registry.
+func (t *engineTrigger) push(ctx context.Context, ev Event, tag string) error {
+	auth, err := json.Marshal(t.auth)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", "http://docker"+t.pushEndpoint(tag), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Registry-Auth", base64.URLEncoding.EncodeToString(auth))
+
+	if err := t.do(ctx, ev.Name, req); err != nil {
+		return fmt.Errorf("could not push '%v:%v': %v", t.image, tag, err)
+	}
+	log.Printf("%v: pushed '%v:%v'", ev.Name, t.image, tag)
+	return nil
+}
+
+// engineMessage is a message from the JSON stream returned by the Docker
+// Engine when building or pushing images.
+type engineMessage struct {
+	Stream      string `json:"stream"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// do performs the given request against the Docker Engine. The output of the
+// engine is logged, and an error is returned if it reported any.
+func (t *engineTrigger) do(ctx context.Context, name string, req *http.Request) error {
+	resp, err := t.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+
+	decoder := json.NewDecoder(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		msg := struct {
+			Message string `json:"message"`
+		}{}
+		decoder.Decode(&msg)
+		return fmt.Errorf("status %v: %v", resp.StatusCode, msg.Message)
+	}
+
+	for {
+		msg := engineMessage{}
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if msg.Error != "" || msg.ErrorDetail.Message != "" {
+			if msg.ErrorDetail.Message != "" {
+				return fmt.Errorf("%v", msg.ErrorDetail.Message)
+			}
+			return fmt.Errorf("%v", msg.Error)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(msg.Stream), "\n") {
+			if line != "" {
+				log.Printf("%v: build: %v", name, line)
+			}
+		}
+	}
+}
+
+// tarDirectory writes a tar archive with the contents of the given directory
+// into the given writer.
+func tarDirectory(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Describe implements the Trigger interface.
+func (t *engineTrigger) Describe(ev Event) []string {
+	endpoint, err := t.buildEndpoint(ev)
+	if err != nil {
+		return []string{"error: " + err.Error()}
+	}
+
+	res := []string{"POST unix://" + t.socket + endpoint + " (context: " + t.context + ")"}
+	for _, tag := range ev.Tags {
+		res = append(res, "POST unix://"+t.socket+t.pushEndpoint(tag))
+	}
+	return res
+}
+
+func (t *engineTrigger) String() string {
+	return "Docker Engine image '" + t.image + "'"
+}
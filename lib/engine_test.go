@@ -0,0 +1,311 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEngine is a fake Docker Engine API server listening on a unix socket.
+type fakeEngine struct {
+	socket   string
+	listener net.Listener
+	failPush bool
+
+	mutex  sync.Mutex
+	files  []string
+	tags   []string
+	args   map[string]string
+	pushed []string
+	auth   registryAuth
+	opened int
+	closed int
+}
+
+func newFakeEngine(t *testing.T, dir string) *fakeEngine {
+	engine := &fakeEngine{socket: filepath.Join(dir, "docker.sock")}
+
+	listener, err := net.Listen("unix", engine.socket)
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	engine.listener = listener
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/build", engine.build)
+	mux.HandleFunc("/images/", engine.push)
+	server := &http.Server{Handler: mux, ConnState: engine.connState}
+	go server.Serve(listener)
+	return engine
+}
+
+// connState counts the connections that were opened and closed.
+func (e *fakeEngine) connState(conn net.Conn, state http.ConnState) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	switch state {
+	case http.StateNew:
+		e.opened++
+	case http.StateClosed, http.StateHijacked:
+		e.closed++
+	}
+}
+
+func (e *fakeEngine) Close() {
+	e.listener.Close()
+}
+
+func (e *fakeEngine) build(w http.ResponseWriter, r *http.Request) {
+	files := []string{}
+	tr := tar.NewReader(r.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		files = append(files, hdr.Name)
+	}
+
+	args := map[string]string{}
+	if err := json.Unmarshal([]byte(r.URL.Query().Get("buildargs")), &args); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	e.mutex.Lock()
+	e.files = files
+	e.tags = r.URL.Query()["t"]
+	e.args = args
+	e.mutex.Unlock()
+
+	if !contains(files, r.URL.Query().Get("dockerfile")) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"message":"Cannot locate specified Dockerfile"}`)
+		return
+	}
+	fmt.Fprintln(w, `{"stream":"Step 1/3 : FROM opensuse/leap:15.0\n"}`)
+	fmt.Fprintln(w, `{"stream":"Successfully built 1234\n"}`)
+}
+
+func (e *fakeEngine) push(w http.ResponseWriter, r *http.Request) {
+	data, _ := base64.URLEncoding.DecodeString(r.Header.Get("X-Registry-Auth"))
+	auth := registryAuth{}
+	json.Unmarshal(data, &auth)
+
+	e.mutex.Lock()
+	e.auth = auth
+	e.mutex.Unlock()
+
+	fmt.Fprintln(w, `{"status":"The push refers to repository [registry.example.com/portus]"}`)
+	if e.failPush {
+		fmt.Fprintln(w, `{"errorDetail":{"message":"denied: requested access to the resource is denied"},"error":"denied"}`)
+		return
+	}
+
+	e.mutex.Lock()
+	e.pushed = append(e.pushed, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/push")+":"+r.URL.Query().Get("tag"))
+	e.mutex.Unlock()
+}
+
+func engineConfig(socket string) TriggerConfig {
+	return TriggerConfig{
+		Type: "engine",
+		Options: map[string]interface{}{
+			"socket":     socket,
+			"context":    getPath("test/engine"),
+			"image":      "registry.example.com/portus",
+			"build_args": map[interface{}]interface{}{"VERSION": "2.4"},
+			"registry": map[interface{}]interface{}{
+				"username": "user",
+				"password": "password",
+				"server":   "registry.example.com",
+			},
+		},
+	}
+}
+
+func TestEngineFire(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	engine := newFakeEngine(t, dir)
+	defer engine.Close()
+
+	trigger, err := newEngineTrigger(&Configuration{}, Listener{Name: "portus-head"}, engineConfig(engine.socket))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := trigger.Fire(context.Background(), testEvent); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	sort.Strings(engine.files)
+	assertSlice(t, []string{"Dockerfile", "entrypoint.sh"}, engine.files)
+	assertSlice(t, []string{"registry.example.com/portus:head", "registry.example.com/portus:latest"}, engine.tags)
+	assertString(t, "1234", engine.args["OPENHUB_REVISION"])
+	assertString(t, "2.4", engine.args["VERSION"])
+	assertSlice(t, []string{"registry.example.com/portus:head", "registry.example.com/portus:latest"}, engine.pushed)
+	assertString(t, "user", engine.auth.Username)
+	assertString(t, "password", engine.auth.Password)
+	assertString(t, "registry.example.com", engine.auth.ServerAddress)
+
+	logged := buf.String()
+	if !strings.Contains(logged, "portus-head: build: Successfully built 1234") {
+		t.Fatalf("Wrong log")
+	}
+	if !strings.Contains(logged, "portus-head: pushed 'registry.example.com/portus:latest'") {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestEngineCloseIdleConnections(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	engine := newFakeEngine(t, dir)
+	defer engine.Close()
+
+	cfg := &Configuration{}
+	list := Listener{Name: "portus-head"}
+	trigger, err := newEngineTrigger(cfg, list, engineConfig(engine.socket))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if timeout := transportOf(t, trigger.(*engineTrigger).client).IdleConnTimeout; timeout != defaultIdleConnTimeout {
+		t.Fatalf("Expecting the default idle timeout, got %v", timeout)
+	}
+	list.trigger = trigger
+	cfg.Listeners = []Listener{list}
+
+	if err := trigger.Fire(context.Background(), testEvent); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	// Connections to the engine are closed along with the ones of the
+	// configuration, as done on reloads.
+	cfg.closeIdleConnections()
+	for i := 0; i < 100; i++ {
+		engine.mutex.Lock()
+		opened, closed := engine.opened, engine.closed
+		engine.mutex.Unlock()
+		if opened > 0 && opened == closed {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expecting idle connections to the engine to be closed")
+}
+
+func TestEngineBuildFails(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	engine := newFakeEngine(t, dir)
+	defer engine.Close()
+
+	tc := engineConfig(engine.socket)
+	tc.Options["dockerfile"] = "Dockerfile.unknown"
+	trigger, err := newEngineTrigger(&Configuration{}, Listener{Name: "portus-head"}, tc)
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	err = trigger.Fire(context.Background(), testEvent)
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "could not build 'registry.example.com/portus': status 500: Cannot locate specified Dockerfile", err.Error())
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	if len(engine.pushed) != 0 {
+		t.Fatalf("Expecting nothing to be pushed")
+	}
+}
+
+func TestEnginePushFails(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	engine := newFakeEngine(t, dir)
+	engine.failPush = true
+	defer engine.Close()
+
+	trigger, err := newEngineTrigger(&Configuration{}, Listener{Name: "portus-head"}, engineConfig(engine.socket))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	err = trigger.Fire(context.Background(), testEvent)
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "could not push 'registry.example.com/portus:head': "+
+		"denied: requested access to the resource is denied", err.Error())
+}
+
+func TestEngineDescribe(t *testing.T) {
+	list := Listener{Name: "portus-head", Repository: "opensuse/portus"}
+	tc := triggerConfig("engine", nil, map[string]interface{}{"context": "/srv/portus"})
+	testTriggerDescribe(t, newEngineTrigger, list, tc, Event{Revision: "1234", Tags: []string{"head"}}, []string{
+		"POST unix:///var/run/docker.sock/build?buildargs=%7B%22OPENHUB_REVISION%22%3A%221234%22%7D" +
+			"&dockerfile=Dockerfile&rm=1&t=opensuse%2Fportus%3Ahead (context: /srv/portus)",
+		"POST unix:///var/run/docker.sock/images/opensuse/portus/push?tag=head",
+	})
+}
+
+func TestEngineBadConfiguration(t *testing.T) {
+	testBadTriggerConfiguration(t, newEngineTrigger, Listener{Name: "portus-head"}, "engine", nil, []badTriggerConfiguration{
+		{map[string]interface{}{}, "portus-head service does not provide a build context!"},
+		{map[string]interface{}{"context": "."}, "portus-head service does not provide an image!"},
+		{
+			map[string]interface{}{"context": ".", "image": "portus", "timeout": "-1m"},
+			"portus-head service has a negative build timeout!",
+		},
+	})
+}
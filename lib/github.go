@@ -0,0 +1,189 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// defaultGitHubURL is the base URL of the GitHub API.
+	defaultGitHubURL = "https://api.github.com"
+
+	// RepositoryDispatch is the GitHub event that triggers all the workflows
+	// of a repository listening to the given event type.
+	RepositoryDispatch = "repository_dispatch"
+
+	// WorkflowDispatch is the GitHub event that triggers a single workflow.
+	WorkflowDispatch = "workflow_dispatch"
+)
+
+// gitHubTrigger sends either a `repository_dispatch` or a `workflow_dispatch`
+// event for each tag through the GitHub API.
+type gitHubTrigger struct {
+	apiURL     string
+	repository string
+	token      string
+	event      string
+	eventType  string
+	workflow   string
+	ref        string
+	policy     RetryPolicy
+	client     *http.Client
+}
+
+// newGitHubTrigger returns a GitHub trigger for the given listener.
+func newGitHubTrigger(cfg *Configuration, list Listener, tc TriggerConfig) (Trigger, error) {
+	opts := struct {
+		APIURL     string `yaml:"api_url"`
+		Repository string `yaml:"repository"`
+		Token      string `yaml:"token"`
+		Event      string `yaml:"event"`
+		EventType  string `yaml:"event_type"`
+		Workflow   string `yaml:"workflow"`
+		Ref        string `yaml:"ref"`
+	}{}
+	if err := tc.decode(&opts); err != nil {
+		return nil, fmt.Errorf("%v service: %v", list.Name, err)
+	}
+
+	if opts.APIURL == "" {
+		opts.APIURL = defaultGitHubURL
+	}
+	if opts.Repository == "" {
+		return nil, fmt.Errorf("%v service does not provide a GitHub repository!", list.Name)
+	}
+	if opts.Token == "" {
+		return nil, fmt.Errorf("%v service does not provide a GitHub token!", list.Name)
+	}
+
+	switch opts.Event {
+	case "", RepositoryDispatch:
+		opts.Event = RepositoryDispatch
+		if opts.EventType == "" {
+			opts.EventType = "openhub"
+		}
+	case WorkflowDispatch:
+		if opts.Workflow == "" {
+			return nil, fmt.Errorf("%v service does not provide a GitHub workflow!", list.Name)
+		}
+		if opts.Ref == "" {
+			return nil, fmt.Errorf("%v service does not provide a git ref for the GitHub workflow!", list.Name)
+		}
+	default:
+		return nil, fmt.Errorf("%v service has an unknown GitHub event '%v'!", list.Name, opts.Event)
+	}
+
+	return &gitHubTrigger{
+		apiURL:     strings.TrimSuffix(opts.APIURL, "/"),
+		repository: opts.Repository,
+		token:      opts.Token,
+		event:      opts.Event,
+		eventType:  opts.EventType,
+		workflow:   opts.Workflow,
+		ref:        opts.Ref,
+		policy:     cfg.Retry,
+		client:     cfg.httpClient(),
+	}, nil
+}
+
+// newRequest returns the request that sends the event for the given tag.
+func (t *gitHubTrigger) newRequest(ev Event, tag string) (*http.Request, error) {
+	var endpoint string
+	var payload interface{}
+
+	if t.event == WorkflowDispatch {
+		// Workflows reject inputs that they do not declare, so only the
+		// revision and the tag are given.
+		endpoint = "/repos/" + t.repository + "/actions/workflows/" + url.PathEscape(t.workflow) + "/dispatches"
+		payload = map[string]interface{}{
+			"ref": t.ref,
+			"inputs": map[string]string{
+				"revision": ev.Revision,
+				"tag":      tag,
+			},
+		}
+	} else {
+		endpoint = "/repos/" + t.repository + "/dispatches"
+		payload = map[string]interface{}{
+			"event_type": t.eventType,
+			"client_payload": map[string]string{
+				"name":         ev.Name,
+				"project":      ev.Project,
+				"package":      ev.Package,
+				"distribution": ev.Distribution,
+				"architecture": ev.Architecture,
+				"revision":     ev.Revision,
+				"tag":          tag,
+			},
+		}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", t.apiURL+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// Fire implements the Trigger interface.
+func (t *gitHubTrigger) Fire(ctx context.Context, ev Event) error {
+	for _, tag := range ev.Tags {
+		tag := tag
+		what := "tag '" + tag + "' on GitHub"
+		err := sendTrigger(ctx, t.client, t.policy, what, func() (*http.Request, error) {
+			return t.newRequest(ev, tag)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describe implements the Trigger interface.
+func (t *gitHubTrigger) Describe(ev Event) []string {
+	res := []string{}
+	for _, tag := range ev.Tags {
+		req, err := t.newRequest(ev, tag)
+		if err != nil {
+			res = append(res, "error: "+err.Error())
+			continue
+		}
+		res = append(res, describeRequest(req, t.token))
+	}
+	return res
+}
+
+func (t *gitHubTrigger) String() string {
+	if t.event == WorkflowDispatch {
+		return "GitHub workflow '" + t.workflow + "' of '" + t.repository + "'"
+	}
+	return "GitHub repository '" + t.repository + "'"
+}
@@ -0,0 +1,167 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// gitHubRequest is a request as received by the fake GitHub server.
+type gitHubRequest struct {
+	path    string
+	payload map[string]interface{}
+}
+
+// testGitHub returns a fake GitHub API server which accepts dispatch events
+// authenticated with the "token" token.
+func testGitHub() (*httptest.Server, func() []gitHubRequest) {
+	var mutex sync.Mutex
+	requests := []gitHubRequest{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		payload := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mutex.Lock()
+		requests = append(requests, gitHubRequest{path: r.URL.Path, payload: payload})
+		mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return server, func() []gitHubRequest {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]gitHubRequest{}, requests...)
+	}
+}
+
+// gitHubDefaults contains the minimal options of a GitHub trigger.
+var gitHubDefaults = map[string]interface{}{"repository": "openSUSE/portus", "token": "token"}
+
+func TestGitHubRepositoryDispatch(t *testing.T) {
+	server, requests := testGitHub()
+	defer server.Close()
+
+	trigger, err := newGitHubTrigger(&Configuration{}, Listener{Name: "portus-head"},
+		triggerConfig("github", gitHubDefaults, map[string]interface{}{"api_url": server.URL + "/"}))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := trigger.Fire(context.Background(), testEvent); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	reqs := requests()
+	if len(reqs) != 2 {
+		t.Fatalf("Expecting 2 requests, got %v", len(reqs))
+	}
+	assertString(t, "/repos/openSUSE/portus/dispatches", reqs[0].path)
+	assertString(t, "openhub", reqs[0].payload["event_type"].(string))
+
+	payload := reqs[1].payload["client_payload"].(map[string]interface{})
+	assertString(t, "portus-head", payload["name"].(string))
+	assertString(t, "Virtualization:containers:Portus", payload["project"].(string))
+	assertString(t, "1234", payload["revision"].(string))
+	assertString(t, "latest", payload["tag"].(string))
+}
+
+func TestGitHubWorkflowDispatch(t *testing.T) {
+	server, requests := testGitHub()
+	defer server.Close()
+
+	trigger, err := newGitHubTrigger(&Configuration{}, Listener{Name: "portus-head"},
+		triggerConfig("github", gitHubDefaults, map[string]interface{}{
+			"api_url":  server.URL,
+			"event":    "workflow_dispatch",
+			"workflow": "build.yml",
+			"ref":      "main",
+		}))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := trigger.Fire(context.Background(), testEvent); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	reqs := requests()
+	if len(reqs) != 2 {
+		t.Fatalf("Expecting 2 requests, got %v", len(reqs))
+	}
+	assertString(t, "/repos/openSUSE/portus/actions/workflows/build.yml/dispatches", reqs[0].path)
+	assertString(t, "main", reqs[0].payload["ref"].(string))
+
+	inputs := reqs[0].payload["inputs"].(map[string]interface{})
+	if len(inputs) != 2 {
+		t.Fatalf("Expecting only the revision and the tag as inputs")
+	}
+	assertString(t, "1234", inputs["revision"].(string))
+	assertString(t, "head", inputs["tag"].(string))
+}
+
+func TestGitHubUnauthorized(t *testing.T) {
+	server, _ := testGitHub()
+	defer server.Close()
+
+	trigger, err := newGitHubTrigger(&Configuration{}, Listener{Name: "portus-head"},
+		triggerConfig("github", gitHubDefaults, map[string]interface{}{"api_url": server.URL, "token": "wrong"}))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	err = trigger.Fire(context.Background(), testEvent)
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "status 401 when triggering tag 'head' on GitHub: ", err.Error())
+}
+
+func TestGitHubDescribe(t *testing.T) {
+	ev := Event{Name: "portus-head", Revision: "1234", Tags: []string{"head"}}
+	tc := triggerConfig("github", gitHubDefaults, nil)
+	trigger := testTriggerDescribe(t, newGitHubTrigger, Listener{Name: "portus-head"}, tc, ev, []string{
+		"POST https://api.github.com/repos/openSUSE/portus/dispatches " +
+			"Accept: application/vnd.github+json Authorization: Bearer *** Content-Type: application/json " +
+			`{"client_payload":{"architecture":"","distribution":"","name":"portus-head",` +
+			`"package":"","project":"","revision":"1234","tag":"head"},"event_type":"openhub"}`,
+	})
+	assertString(t, "GitHub repository 'openSUSE/portus'", trigger.String())
+}
+
+func TestGitHubBadConfiguration(t *testing.T) {
+	testBadTriggerConfiguration(t, newGitHubTrigger, Listener{Name: "portus-head"}, "github", gitHubDefaults, []badTriggerConfiguration{
+		{map[string]interface{}{"repository": ""}, "portus-head service does not provide a GitHub repository!"},
+		{map[string]interface{}{"token": ""}, "portus-head service does not provide a GitHub token!"},
+		{map[string]interface{}{"event": "push"}, "portus-head service has an unknown GitHub event 'push'!"},
+		{
+			map[string]interface{}{"event": "workflow_dispatch", "ref": "main"},
+			"portus-head service does not provide a GitHub workflow!",
+		},
+		{
+			map[string]interface{}{"event": "workflow_dispatch", "workflow": "build.yml"},
+			"portus-head service does not provide a git ref for the GitHub workflow!",
+		},
+	})
+}
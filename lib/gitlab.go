@@ -0,0 +1,133 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// defaultGitLabURL is the base URL of the API of GitLab.com.
+const defaultGitLabURL = "https://gitlab.com/api/v4"
+
+// gitLabTrigger runs a pipeline for each tag through the pipeline trigger API
+// of GitLab.
+type gitLabTrigger struct {
+	apiURL    string
+	project   string
+	token     string
+	ref       string
+	variables map[string]string
+	policy    RetryPolicy
+	client    *http.Client
+}
+
+// newGitLabTrigger returns a GitLab trigger for the given listener.
+func newGitLabTrigger(cfg *Configuration, list Listener, tc TriggerConfig) (Trigger, error) {
+	opts := struct {
+		APIURL    string            `yaml:"api_url"`
+		Project   string            `yaml:"project"`
+		Token     string            `yaml:"token"`
+		Ref       string            `yaml:"ref"`
+		Variables map[string]string `yaml:"variables"`
+	}{}
+	if err := tc.decode(&opts); err != nil {
+		return nil, fmt.Errorf("%v service: %v", list.Name, err)
+	}
+
+	if opts.APIURL == "" {
+		opts.APIURL = defaultGitLabURL
+	}
+	if opts.Project == "" {
+		return nil, fmt.Errorf("%v service does not provide a GitLab project!", list.Name)
+	}
+	if opts.Token == "" {
+		return nil, fmt.Errorf("%v service does not provide a GitLab trigger token!", list.Name)
+	}
+	if opts.Ref == "" {
+		return nil, fmt.Errorf("%v service does not provide a git ref for the GitLab pipeline!", list.Name)
+	}
+
+	return &gitLabTrigger{
+		apiURL:    strings.TrimSuffix(opts.APIURL, "/"),
+		project:   opts.Project,
+		token:     opts.Token,
+		ref:       opts.Ref,
+		variables: opts.Variables,
+		policy:    cfg.Retry,
+		client:    cfg.httpClient(),
+	}, nil
+}
+
+// newRequest returns the request that runs the pipeline for the given tag.
+// Besides the configured variables, the pipeline gets the data of the event
+// as `OPENHUB_*` variables.
+func (t *gitLabTrigger) newRequest(ev Event, tag string) (*http.Request, error) {
+	form := url.Values{}
+	form.Set("token", t.token)
+	form.Set("ref", t.ref)
+	for k, v := range t.variables {
+		form.Set("variables["+k+"]", v)
+	}
+	for k, v := range eventVariables(ev, tag) {
+		form.Set("variables["+k+"]", v)
+	}
+
+	// The project can be given by its path, which has to be a single segment.
+	endpoint := t.apiURL + "/projects/" + url.PathEscape(t.project) + "/trigger/pipeline"
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// Fire implements the Trigger interface.
+func (t *gitLabTrigger) Fire(ctx context.Context, ev Event) error {
+	for _, tag := range ev.Tags {
+		tag := tag
+		what := "tag '" + tag + "' on GitLab"
+		err := sendTrigger(ctx, t.client, t.policy, what, func() (*http.Request, error) {
+			return t.newRequest(ev, tag)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describe implements the Trigger interface.
+func (t *gitLabTrigger) Describe(ev Event) []string {
+	res := []string{}
+	for _, tag := range ev.Tags {
+		req, err := t.newRequest(ev, tag)
+		if err != nil {
+			res = append(res, "error: "+err.Error())
+			continue
+		}
+		res = append(res, describeRequest(req, t.token, url.QueryEscape(t.token)))
+	}
+	return res
+}
+
+func (t *gitLabTrigger) String() string {
+	return "GitLab project '" + t.project + "'"
+}
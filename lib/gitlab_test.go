@@ -0,0 +1,129 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// testGitLab returns a fake GitLab server which runs pipelines for the
+// "group/portus" project when given the "token" trigger token.
+func testGitLab() (*httptest.Server, func() []url.Values) {
+	var mutex sync.Mutex
+	pipelines := []url.Values{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RequestURI != "/api/v4/projects/group%2Fportus/trigger/pipeline" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message":"401 Unauthorized"}`))
+			return
+		}
+
+		mutex.Lock()
+		pipelines = append(pipelines, r.PostForm)
+		mutex.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":1,"status":"pending"}`))
+	}))
+	return server, func() []url.Values {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]url.Values{}, pipelines...)
+	}
+}
+
+// gitLabDefaults contains the minimal options of a GitLab trigger.
+var gitLabDefaults = map[string]interface{}{"project": "group/portus", "token": "token", "ref": "master"}
+
+func TestGitLabFire(t *testing.T) {
+	server, pipelines := testGitLab()
+	defer server.Close()
+
+	trigger, err := newGitLabTrigger(&Configuration{}, Listener{Name: "portus-head"},
+		triggerConfig("gitlab", gitLabDefaults, map[string]interface{}{
+			"api_url":   server.URL + "/api/v4/",
+			"variables": map[interface{}]interface{}{"IMAGE": "portus"},
+		}))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := trigger.Fire(context.Background(), testEvent); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	forms := pipelines()
+	if len(forms) != 2 {
+		t.Fatalf("Expecting 2 pipelines, got %v", len(forms))
+	}
+	assertString(t, "master", forms[0].Get("ref"))
+	assertString(t, "portus", forms[0].Get("variables[IMAGE]"))
+	assertString(t, "portus-head", forms[0].Get("variables[OPENHUB_NAME]"))
+	assertString(t, "Virtualization:containers:Portus", forms[0].Get("variables[OPENHUB_PROJECT]"))
+	assertString(t, "portus", forms[0].Get("variables[OPENHUB_PACKAGE]"))
+	assertString(t, "openSUSE_Leap_42.3", forms[0].Get("variables[OPENHUB_DISTRIBUTION]"))
+	assertString(t, "x86_64", forms[0].Get("variables[OPENHUB_ARCHITECTURE]"))
+	assertString(t, "1234", forms[0].Get("variables[OPENHUB_REVISION]"))
+	assertString(t, "head", forms[0].Get("variables[OPENHUB_TAG]"))
+	assertString(t, "latest", forms[1].Get("variables[OPENHUB_TAG]"))
+}
+
+func TestGitLabWrongToken(t *testing.T) {
+	server, pipelines := testGitLab()
+	defer server.Close()
+
+	trigger, err := newGitLabTrigger(&Configuration{}, Listener{Name: "portus-head"},
+		triggerConfig("gitlab", gitLabDefaults, map[string]interface{}{"api_url": server.URL + "/api/v4", "token": "wrong"}))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	err = trigger.Fire(context.Background(), testEvent)
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, `status 401 when triggering tag 'head' on GitLab: {"message":"401 Unauthorized"}`, err.Error())
+	if len(pipelines()) != 0 {
+		t.Fatalf("Expecting no pipelines")
+	}
+}
+
+func TestGitLabDescribe(t *testing.T) {
+	ev := Event{Name: "portus-head", Revision: "1234", Tags: []string{"head"}}
+	tc := triggerConfig("gitlab", gitLabDefaults, map[string]interface{}{"token": "to/ken"})
+	testTriggerDescribe(t, newGitLabTrigger, Listener{Name: "portus-head"}, tc, ev, []string{
+		"POST https://gitlab.com/api/v4/projects/group%2Fportus/trigger/pipeline " +
+			"Content-Type: application/x-www-form-urlencoded " +
+			"ref=master&token=***&variables%5BOPENHUB_ARCHITECTURE%5D=&variables%5BOPENHUB_DISTRIBUTION%5D=" +
+			"&variables%5BOPENHUB_NAME%5D=portus-head&variables%5BOPENHUB_PACKAGE%5D=" +
+			"&variables%5BOPENHUB_PROJECT%5D=&variables%5BOPENHUB_REVISION%5D=1234&variables%5BOPENHUB_TAG%5D=head",
+	})
+}
+
+func TestGitLabBadConfiguration(t *testing.T) {
+	testBadTriggerConfiguration(t, newGitLabTrigger, Listener{Name: "portus-head"}, "gitlab", gitLabDefaults, []badTriggerConfiguration{
+		{map[string]interface{}{"project": ""}, "portus-head service does not provide a GitLab project!"},
+		{map[string]interface{}{"token": ""}, "portus-head service does not provide a GitLab trigger token!"},
+		{map[string]interface{}{"ref": ""}, "portus-head service does not provide a git ref for the GitLab pipeline!"},
+	})
+}
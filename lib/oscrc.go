@@ -0,0 +1,149 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Credential managers from osc which store the password in the oscrc file.
+const (
+	oscPlaintextManager  = "osc.credentials.PlaintextConfigFileCredentialsManager"
+	oscObfuscatedManager = "osc.credentials.ObfuscatedConfigFileCredentialsManager"
+)
+
+// ReadOscrc returns the user and the password for the given apiurl from the
+// given osc configuration file. Both plain and obfuscated passwords are
+// supported, but not the ones stored in a keyring.
+func ReadOscrc(path, apiurl string) (string, string, error) {
+	sections, err := parseIni(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	section, ok := sections[normalizeAPIURL(apiurl)]
+	if !ok {
+		return "", "", fmt.Errorf("no credentials for '%v' in '%v'", apiurl, path)
+	}
+
+	manager := section["credentials_mgr_class"]
+	if idx := strings.Index(manager, ":"); idx >= 0 {
+		manager = manager[:idx]
+	}
+
+	switch {
+	case section["passx"] != "":
+		// Obfuscated password from old versions of osc.
+		password, err := deobfuscate(section["passx"])
+		return section["user"], password, err
+	case manager == oscObfuscatedManager:
+		password, err := deobfuscate(section["pass"])
+		return section["user"], password, err
+	case manager == "" || manager == oscPlaintextManager:
+		if section["pass"] == "" {
+			return "", "", fmt.Errorf("no password for '%v' in '%v'", apiurl, path)
+		}
+		return section["user"], section["pass"], nil
+	}
+	return "", "", fmt.Errorf("unsupported credentials manager '%v' for '%v'", manager, apiurl)
+}
+
+// normalizeAPIURL returns the given apiurl as used to match sections of the
+// oscrc file. As done by osc, URLs without a scheme are assumed to be HTTPS.
+func normalizeAPIURL(apiurl string) string {
+	apiurl = strings.TrimSuffix(strings.TrimSpace(apiurl), "/")
+	if !strings.Contains(apiurl, "://") {
+		apiurl = "https://" + apiurl
+	}
+	return apiurl
+}
+
+// deobfuscate returns the password obfuscated by osc, which is compressed
+// with bzip2 and then encoded in base64.
+func deobfuscate(value string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("bad obfuscated password: %v", err)
+	}
+	password, err := ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return "", fmt.Errorf("bad obfuscated password: %v", err)
+	}
+	return string(password), nil
+}
+
+// parseIni returns the sections of the given INI file, keyed by their
+// normalized apiurl. Keys are lower-cased, and both `=` and `:` are accepted
+// as separators.
+func parseIni(path string) (map[string]map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sections := make(map[string]map[string]string)
+	var current map[string]string
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = make(map[string]string)
+			sections[normalizeAPIURL(line[1:len(line)-1])] = current
+			continue
+		}
+
+		idx := strings.IndexAny(line, "=:")
+		if idx < 0 || current == nil {
+			return nil, fmt.Errorf("%v:%v: unexpected line", path, n)
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:idx]))
+		current[key] = strings.TrimSpace(line[idx+1:])
+	}
+	return sections, scanner.Err()
+}
+
+// fromOscrc fills the user and the password from the oscrc file of the given
+// credentials, unless both of them were already given.
+func (crd Credentials) fromOscrc() (Credentials, error) {
+	if crd.Oscrc == "" || (crd.User != "" && crd.Password != "") {
+		return crd, nil
+	}
+
+	user, password, err := ReadOscrc(crd.Oscrc, crd.Server)
+	if err != nil {
+		return crd, err
+	}
+	if crd.User == "" {
+		crd.User = user
+	}
+	if crd.Password == "" {
+		crd.Password = password
+	}
+	return crd, nil
+}
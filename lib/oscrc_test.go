@@ -0,0 +1,88 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadOscrc(t *testing.T) {
+	path := getPath("test/osc/oscrc")
+
+	for _, c := range []struct {
+		apiurl, user, password string
+	}{
+		{"https://api.opensuse.org", "plain-user", "plain-password"},
+		{"https://api.opensuse.org/", "plain-user", "plain-password"},
+		{"https://obs.example.com", "obfuscated-user", "obfuscated-password"},
+		{"https://build.example.com", "legacy-user", "legacy-password"},
+	} {
+		user, password, err := ReadOscrc(path, c.apiurl)
+		if err != nil {
+			t.Fatalf("Expecting no errors for %v, got: %v", c.apiurl, err)
+		}
+		assertString(t, c.user, user)
+		assertString(t, c.password, password)
+	}
+}
+
+func TestReadOscrcErrors(t *testing.T) {
+	path := getPath("test/osc/oscrc")
+
+	_, _, err := ReadOscrc(path, "https://unknown.example.com")
+	if err == nil || !strings.HasPrefix(err.Error(), "no credentials for 'https://unknown.example.com'") {
+		t.Fatalf("Wrong error: %v", err)
+	}
+
+	_, _, err = ReadOscrc(path, "https://keyring.example.com")
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "unsupported credentials manager 'osc.credentials.KeyringCredentialsManager' "+
+		"for 'https://keyring.example.com'", err.Error())
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	bad := filepath.Join(dir, "oscrc")
+	ioutil.WriteFile(bad, []byte("user = orphan\n"), 0600)
+	_, _, err = ReadOscrc(bad, "https://api.opensuse.org")
+	if err == nil || !strings.HasSuffix(err.Error(), "oscrc:1: unexpected line") {
+		t.Fatalf("Wrong error: %v", err)
+	}
+}
+
+func TestParseConfigurationOscrc(t *testing.T) {
+	crd := Credentials{Server: "https://obs.example.com", Oscrc: getPath("test/osc/oscrc")}
+	cfg, err := ParseConfiguration(getPath("test/noarchnodist.yml"), crd, Options{})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, "obfuscated-user", cfg.User)
+	assertString(t, "obfuscated-password", cfg.Password)
+
+	// Explicit credentials take precedence.
+	crd.User = "user"
+	cfg, err = ParseConfiguration(getPath("test/noarchnodist.yml"), crd, Options{})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, "user", cfg.User)
+	assertString(t, "obfuscated-password", cfg.Password)
+}
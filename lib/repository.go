@@ -0,0 +1,184 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// rpmPackage is a package as described in the primary metadata of an rpm-md
+// repository.
+type rpmPackage struct {
+	Name         string `xml:"name"`
+	Architecture string `xml:"arch"`
+	Version      struct {
+		Version string `xml:"ver,attr"`
+		Release string `xml:"rel,attr"`
+	} `xml:"version"`
+}
+
+// packageInRepository returns true if the package of the given listener, at the
+// version and release from the given build info, is available in the rpm-md
+// repository located at `list.VerifyRepoURL`.
+func packageInRepository(ctx context.Context, cfg *Configuration, list Listener, info *buildInfo) bool {
+	found, err := findPackage(ctx, cfg, list, info)
+	if err != nil {
+		log.Printf("%v: could not check the repository: %v", list.Name, err)
+		return false
+	}
+	if !found {
+		log.Printf("%v: package '%v-%v-%v' is not yet available in the repository, waiting...",
+			list.Name, list.Package, info.version(), info.Release)
+	}
+	return found
+}
+
+// findPackage looks for the package of the given listener in the primary
+// metadata of the repository.
+func findPackage(ctx context.Context, cfg *Configuration, list Listener, info *buildInfo) (bool, error) {
+	base, err := url.Parse(list.VerifyRepoURL)
+	if err != nil {
+		return false, fmt.Errorf("bad verify_repo_url")
+	}
+
+	location, err := primaryLocation(ctx, cfg, repositoryURL(base, "repodata/repomd.xml"))
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := repositoryRequest(ctx, cfg, repositoryURL(base, location))
+	if err != nil {
+		return false, err
+	}
+	defer closeBody(resp)
+
+	var reader io.Reader = resp.Body
+	if strings.HasSuffix(location, ".gz") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return false, err
+		}
+		defer gz.Close()
+		reader = gz
+	} else if !strings.HasSuffix(location, ".xml") {
+		return false, fmt.Errorf("unsupported compression for '%v'", location)
+	}
+
+	// The primary metadata can be quite big, so packages are decoded one by
+	// one instead of all at once.
+	decoder := xml.NewDecoder(reader)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "package" {
+			continue
+		}
+		pkg := rpmPackage{}
+		if err := decoder.DecodeElement(&pkg, &start); err != nil {
+			return false, err
+		}
+		if matchesPackage(pkg, list, info) {
+			return true, nil
+		}
+	}
+}
+
+// matchesPackage returns true if the given package from the repository is the
+// one being built for the given listener.
+func matchesPackage(pkg rpmPackage, list Listener, info *buildInfo) bool {
+	if pkg.Name != list.Package {
+		return false
+	}
+	if pkg.Architecture != list.Architecture && pkg.Architecture != "noarch" {
+		return false
+	}
+	if pkg.Version.Version != info.version() {
+		return false
+	}
+	return info.Release == "" || pkg.Version.Release == info.Release
+}
+
+// primaryLocation returns the location of the primary metadata as specified
+// by the given `repomd.xml` URL.
+func primaryLocation(ctx context.Context, cfg *Configuration, u *url.URL) (string, error) {
+	resp, err := repositoryRequest(ctx, cfg, u)
+	if err != nil {
+		return "", err
+	}
+	defer closeBody(resp)
+
+	repomd := struct {
+		XMLName xml.Name `xml:"repomd"`
+		Data    []struct {
+			Type     string `xml:"type,attr"`
+			Location struct {
+				Href string `xml:"href,attr"`
+			} `xml:"location"`
+		} `xml:"data"`
+	}{}
+
+	decoder := xml.NewDecoder(resp.Body)
+	if err := decoder.Decode(&repomd); err != nil {
+		return "", err
+	}
+	for _, data := range repomd.Data {
+		if data.Type == "primary" && data.Location.Href != "" {
+			return data.Location.Href, nil
+		}
+	}
+	return "", fmt.Errorf("no primary metadata in '%v'", redactURL(u))
+}
+
+// repositoryURL returns the URL of the given path relative to the given base
+// URL of a repository. The query of the base URL is kept, since it might
+// contain the credentials to access the repository.
+func repositoryURL(base *url.URL, path string) *url.URL {
+	res := *base
+	res.Path = strings.TrimSuffix(base.Path, "/") + "/" + path
+	res.RawPath = ""
+	return &res
+}
+
+// repositoryRequest performs a GET request to the given URL and returns the
+// response if it was successful.
+func repositoryRequest(ctx context.Context, cfg *Configuration, u *url.URL) (*http.Response, error) {
+	what := redactURL(u)
+	resp, err := doWithRetry(ctx, cfg.httpClient(), cfg.Retry, what, func() (*http.Request, error) {
+		return http.NewRequest("GET", u.String(), nil)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch '%v': %v", what, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		closeBody(resp)
+		return nil, fmt.Errorf("status %v when fetching '%v'", resp.StatusCode, what)
+	}
+	return resp, nil
+}
@@ -0,0 +1,238 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRepository returns a server that serves the fixture repository from
+// `test/repo`. Files ending with `.gz` are compressed on the fly from their
+// uncompressed counterpart.
+func testRepository() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := filepath.Join(getPath("test/repo"), filepath.FromSlash(r.URL.Path))
+		compress := strings.HasSuffix(path, ".gz")
+
+		data, err := ioutil.ReadFile(strings.TrimSuffix(path, ".gz"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !compress {
+			w.Write(data)
+			return
+		}
+		gz := gzip.NewWriter(w)
+		gz.Write(data)
+		gz.Close()
+	}))
+}
+
+func testPackageInRepository(t *testing.T, url string, info *buildInfo) (bool, string) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	res := packageInRepository(context.Background(), &Configuration{}, Listener{
+		Name:          "portus-head",
+		Architecture:  "x86_64",
+		Package:       "portus",
+		VerifyRepoURL: url,
+	}, info)
+	return res, buf.String()
+}
+
+func TestPackageInRepositoryOK(t *testing.T) {
+	server := testRepository()
+	defer server.Close()
+
+	res, _ := testPackageInRepository(t, server.URL, &buildInfo{
+		VersionRelease: "2.4.0-1.1",
+		Release:        "lp150.1.1",
+	})
+	if !res {
+		t.Fatalf("Expecting to be OK")
+	}
+
+	// Trailing slashes are fine.
+	res, _ = testPackageInRepository(t, server.URL+"/", &buildInfo{
+		VersionRelease: "2.4.0-1.1",
+		Release:        "lp150.1.1",
+	})
+	if !res {
+		t.Fatalf("Expecting to be OK")
+	}
+}
+
+func TestPackageInRepositoryOldRelease(t *testing.T) {
+	server := testRepository()
+	defer server.Close()
+
+	res, logged := testPackageInRepository(t, server.URL, &buildInfo{
+		VersionRelease: "2.4.0-2.1",
+		Release:        "lp150.2.1",
+	})
+	if res {
+		t.Fatalf("Expecting NOT to be OK")
+	}
+	msg := "portus-head: package 'portus-2.4.0-lp150.2.1' is not yet available in the repository, waiting..."
+	if !strings.Contains(logged, msg) {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestPackageInRepositoryOldVersion(t *testing.T) {
+	server := testRepository()
+	defer server.Close()
+
+	res, _ := testPackageInRepository(t, server.URL, &buildInfo{
+		VersionRelease: "2.5.0-1.1",
+		Release:        "lp150.1.1",
+	})
+	if res {
+		t.Fatalf("Expecting NOT to be OK")
+	}
+}
+
+func TestPackageInRepositoryUncompressed(t *testing.T) {
+	server := testRepository()
+	defer server.Close()
+
+	repomd := `<repomd><data type="primary"><location href="primary.xml"/></data></repomd>`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repodata/repomd.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, repomd)
+	})
+	mux.HandleFunc("/primary.xml", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, server.URL+"/repodata/primary.xml", http.StatusFound)
+	})
+	plain := httptest.NewServer(mux)
+	defer plain.Close()
+
+	res, _ := testPackageInRepository(t, plain.URL, &buildInfo{
+		VersionRelease: "2.4.0-1.1",
+		Release:        "lp150.1.1",
+	})
+	if !res {
+		t.Fatalf("Expecting to be OK")
+	}
+}
+
+func TestPackageInRepositoryNotFound(t *testing.T) {
+	server := testRepository()
+	defer server.Close()
+
+	res, logged := testPackageInRepository(t, server.URL+"/unknown", &buildInfo{
+		VersionRelease: "2.4.0-1.1",
+	})
+	if res {
+		t.Fatalf("Expecting NOT to be OK")
+	}
+	if !strings.Contains(logged, "portus-head: could not check the repository: status 404") {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestPackageInRepositoryRedactsURL(t *testing.T) {
+	server := testRepository()
+	defer server.Close()
+
+	u := strings.Replace(server.URL, "http://", "http://user:secret@", 1) + "/unknown?token=secret"
+	res, logged := testPackageInRepository(t, u, &buildInfo{VersionRelease: "2.4.0-1.1"})
+	if res {
+		t.Fatalf("Expecting NOT to be OK")
+	}
+	if strings.Contains(logged, "secret") {
+		t.Fatalf("Expecting credentials not to be logged: %v", logged)
+	}
+	if !strings.Contains(logged, "'http://***@"+strings.TrimPrefix(server.URL, "http://")+"/unknown/repodata/repomd.xml?token=***'") {
+		t.Fatalf("Wrong log: %v", logged)
+	}
+}
+
+func TestPackageInRepositoryKeepsQuery(t *testing.T) {
+	repo := testRepository()
+	defer repo.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		repo.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	res, logged := testPackageInRepository(t, server.URL+"/?token=secret", &buildInfo{
+		VersionRelease: "2.4.0-1.1",
+		Release:        "lp150.1.1",
+	})
+	if !res {
+		t.Fatalf("Expecting to be OK: %v", logged)
+	}
+}
+
+func TestPackageInRepositoryUnreachable(t *testing.T) {
+	server := testRepository()
+	server.Close()
+
+	res, logged := testPackageInRepository(t, server.URL+"?token=secret", &buildInfo{VersionRelease: "2.4.0-1.1"})
+	if res {
+		t.Fatalf("Expecting NOT to be OK")
+	}
+	if strings.Contains(logged, "secret") {
+		t.Fatalf("Expecting credentials not to be logged: %v", logged)
+	}
+	if !strings.Contains(logged, "portus-head: could not check the repository: could not fetch '"+
+		server.URL+"/repodata/repomd.xml?token=***': ") {
+		t.Fatalf("Wrong log: %v", logged)
+	}
+}
+
+func TestMatchesPackage(t *testing.T) {
+	list := Listener{Package: "portus", Architecture: "x86_64"}
+	info := &buildInfo{VersionRelease: "2.4.0-1.1", Release: "lp150.1.1"}
+
+	pkg := rpmPackage{Name: "portus", Architecture: "noarch"}
+	pkg.Version.Version = "2.4.0"
+	pkg.Version.Release = "lp150.1.1"
+	if !matchesPackage(pkg, list, info) {
+		t.Fatalf("Expecting noarch packages to match")
+	}
+
+	pkg.Architecture = "aarch64"
+	if matchesPackage(pkg, list, info) {
+		t.Fatalf("Expecting other architectures NOT to match")
+	}
+
+	// If OBS does not report the release, then only the version is checked.
+	pkg.Architecture = "x86_64"
+	pkg.Version.Release = "whatever"
+	if !matchesPackage(pkg, list, &buildInfo{VersionRelease: "2.4.0-1.1"}) {
+		t.Fatalf("Expecting to match")
+	}
+}
@@ -17,30 +17,65 @@ package lib
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"encoding/xml"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 )
 
 var requestTimeout = 15 * time.Second
 var dockerHub = "https://registry.hub.docker.com/u/"
 
-func request(cfg *Configuration, method, endpoint string) (*http.Response, error) {
-	client := http.Client{Timeout: requestTimeout}
+func request(ctx context.Context, cfg *Configuration, list Listener, method, endpoint string) (*http.Response, error) {
+	srv, err := serverFor(cfg, list)
+	if err != nil {
+		return nil, err
+	}
 
-	req, _ := http.NewRequest(method, cfg.Server+endpoint, nil)
-	req.SetBasicAuth(cfg.User, cfg.Password)
+	client := srv.httpClient()
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequest(method, srv.URL+endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := authenticate(srv, req); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
 
-	return client.Do(req)
+	resp, err := doWithRetry(ctx, client, cfg.Retry, endpoint, newRequest)
+	if err != nil || srv.Auth.Type != AuthSignature {
+		return resp, err
+	}
+
+	// The first request to the server (or any request after the challenge
+	// changed) gets the challenge to be signed, so it has to be sent again.
+	realm, ok := signatureChallenge(resp)
+	if !ok {
+		return resp, err
+	}
+	closeBody(resp)
+
+	signatureRealms.Lock()
+	signatureRealms.realms[srv.URL] = realm
+	signatureRealms.Unlock()
+	return doWithRetry(ctx, client, cfg.Retry, endpoint, newRequest)
 }
 
-func safeRequest(pre, post string, cfg *Configuration, list Listener) (*http.Response, bool) {
+func safeRequest(ctx context.Context, pre, post string, cfg *Configuration, list Listener) (*http.Response, bool) {
 	endpoint := filepath.Join(pre, list.Project, list.Distribution,
 		list.Architecture, list.Package, post)
-	resp, err := request(cfg, "GET", endpoint)
+	resp, err := request(ctx, cfg, list, "GET", endpoint)
 	if err != nil {
 		log.Printf("error: %v", err)
 		return nil, false
@@ -48,16 +83,18 @@ func safeRequest(pre, post string, cfg *Configuration, list Listener) (*http.Res
 
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("Status %v when checking the status", resp.StatusCode)
+		closeBody(resp)
 		return nil, false
 	}
 	return resp, true
 }
 
-func statusSucceeded(cfg *Configuration, list Listener) bool {
-	resp, b := safeRequest("/build", "_status", cfg, list)
+func statusSucceeded(ctx context.Context, cfg *Configuration, list Listener) bool {
+	resp, b := safeRequest(ctx, "/build", "_status", cfg, list)
 	if !b {
 		return b
 	}
+	defer closeBody(resp)
 
 	status := struct {
 		XMLName xml.Name `xml:"status"`
@@ -73,45 +110,549 @@ func statusSucceeded(cfg *Configuration, list Listener) bool {
 	return status.Code == "succeeded"
 }
 
-func fetchRevision(cfg *Configuration, list Listener) string {
-	resp, b := safeRequest("/build", "_buildinfo", cfg, list)
+// buildInfo contains the relevant data from the `_buildinfo` of a package.
+type buildInfo struct {
+	XMLName        xml.Name `xml:"buildinfo"`
+	Revision       string   `xml:"rev"`
+	VersionRelease string   `xml:"versrel"`
+	Release        string   `xml:"release"`
+}
+
+// version returns the version of the package being built.
+func (info *buildInfo) version() string {
+	if idx := strings.LastIndex(info.VersionRelease, "-"); idx > 0 {
+		return info.VersionRelease[:idx]
+	}
+	return info.VersionRelease
+}
+
+func fetchBuildInfo(ctx context.Context, cfg *Configuration, list Listener) *buildInfo {
+	resp, b := safeRequest(ctx, "/build", "_buildinfo", cfg, list)
 	if !b {
-		return ""
+		return nil
+	}
+	defer closeBody(resp)
+
+	info := &buildInfo{}
+	decoder := xml.NewDecoder(resp.Body)
+	if err := decoder.Decode(info); err != nil {
+		log.Printf("error: %v", err)
+		return nil
+	}
+	return info
+}
+
+func fetchRevision(ctx context.Context, cfg *Configuration, list Listener) string {
+	if info := fetchBuildInfo(ctx, cfg, list); info != nil {
+		return info.Revision
 	}
+	return ""
+}
+
+// repositoryPublished returns true if OBS has finished publishing the
+// repository of the given listener. That is, the repository has the
+// "published" state and it is not dirty.
+func repositoryPublished(ctx context.Context, cfg *Configuration, list Listener) bool {
+	query := url.Values{}
+	query.Set("repository", list.Distribution)
+	query.Set("arch", list.Architecture)
+	query.Set("package", list.Package)
 
-	info := struct {
-		XMLName  xml.Name `xml:"buildinfo"`
-		Revision string   `xml:"rev"`
+	endpoint := "/build/" + list.Project + "/_result?" + query.Encode()
+	resp, err := request(ctx, cfg, list, "GET", endpoint)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return false
+	}
+	defer closeBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Status %v when checking the result", resp.StatusCode)
+		return false
+	}
+
+	results := struct {
+		XMLName xml.Name `xml:"resultlist"`
+		Results []struct {
+			Repository   string `xml:"repository,attr"`
+			Architecture string `xml:"arch,attr"`
+			State        string `xml:"state,attr"`
+			Dirty        string `xml:"dirty,attr"`
+		} `xml:"result"`
 	}{}
 
 	decoder := xml.NewDecoder(resp.Body)
-	if err := decoder.Decode(&info); err != nil {
+	if err := decoder.Decode(&results); err != nil {
 		log.Printf("error: %v", err)
-		return ""
+		return false
+	}
+
+	for _, res := range results.Results {
+		if res.Repository != list.Distribution || res.Architecture != list.Architecture {
+			continue
+		}
+		if res.State == "published" && res.Dirty != "true" {
+			return true
+		}
+		state := res.State
+		if res.Dirty == "true" {
+			state += ", dirty"
+		}
+		log.Printf("%v: repository is still being published (%v), waiting...", list.Name, state)
+		return false
+	}
+	log.Printf("%v: could not find the repository '%v' for '%v'",
+		list.Name, list.Distribution, list.Architecture)
+	return false
+}
+
+// newHubRequest returns the request that triggers a build of the given tag on
+// Docker Hub through the legacy trigger endpoint.
+func newHubRequest(token, repository, tag string) (*http.Request, error) {
+	endpoint := dockerHub + repository + "/trigger/" + token + "/"
+	reader := bytes.NewBuffer([]byte("{\"docker_tag\": \"" + tag + "\"}"))
+
+	req, err := http.NewRequest("POST", endpoint, reader)
+	if err != nil {
+		return nil, err
 	}
-	return info.Revision
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
 }
 
-func updateHub(token, repository string, tags []string) bool {
-	client := http.Client{Timeout: requestTimeout}
-	url := dockerHub + repository + "/trigger/" + token + "/"
+// newHubSourceRequest returns the request that triggers a build of the given
+// source on Docker Hub through a trigger URL of the form
+// `/api/build/v1/source/<uuid>/trigger/<uuid>/call/`.
+func newHubSourceRequest(triggerURL, sourceType, sourceName string) (*http.Request, error) {
+	body, err := json.Marshal(map[string]string{
+		"source_type": sourceType,
+		"source_name": sourceName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", triggerURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
 
+// describeHubRequests returns a description of the requests returned by
+// `newRequest` for each of the given tags.
+func describeHubRequests(tags []string, newRequest func(string) (*http.Request, error), secrets ...string) []string {
+	res := []string{}
 	for _, tag := range tags {
-		reader := bytes.NewBuffer([]byte("{\"docker_tag\": \"" + tag + "\"}"))
-		req, _ := http.NewRequest("POST", url, reader)
-		req.Header.Set("Content-Type", "application/json")
+		req, err := newRequest(tag)
+		if err != nil {
+			res = append(res, "error: "+err.Error())
+			continue
+		}
+		res = append(res, describeRequest(req, secrets...))
+	}
+	return res
+}
+
+// describeRequest returns a one-line description of the given request, which
+// includes its method, URL, headers and body. The given secrets are redacted,
+// as well as anything that redactURL would.
+func describeRequest(req *http.Request, secrets ...string) string {
+	parts := []string{req.Method, redactURL(req.URL)}
+
+	keys := []string{}
+	for k := range req.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		parts = append(parts, k+": "+strings.Join(req.Header[k], ", "))
+	}
+
+	if req.Body != nil {
+		b, _ := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		parts = append(parts, string(b))
+	}
+
+	res := strings.Join(parts, " ")
+	for _, secret := range secrets {
+		if secret != "" {
+			res = strings.Replace(res, secret, "***", -1)
+		}
+	}
+	return res
+}
+
+// redactURL returns the given URL with its user information and the values
+// of its query redacted, since they might contain credentials.
+func redactURL(u *url.URL) string {
+	res := *u
+	res.User = nil
+	if res.RawQuery != "" {
+		keys := []string{}
+		for k := range res.Query() {
+			keys = append(keys, url.QueryEscape(k)+"=***")
+		}
+		sort.Strings(keys)
+		res.RawQuery = strings.Join(keys, "&")
+	}
+	if u.User != nil {
+		return strings.Replace(res.String(), "://", "://***@", 1)
+	}
+	return res.String()
+}
 
-		resp, err := client.Do(req)
+// pushHub performs with the given client the request returned by
+// `newRequest` for each of the given tags, and returns true if all of them
+// succeeded.
+func pushHub(ctx context.Context, client *http.Client, policy RetryPolicy, tags []string,
+	newRequest func(string) (*http.Request, error)) bool {
+
+	for _, tag := range tags {
+		tag := tag
+		what := "tag '" + tag + "' on Docker Hub"
+		resp, err := doWithRetry(ctx, client, policy, what, func() (*http.Request, error) {
+			return newRequest(tag)
+		})
 		if err != nil {
 			log.Printf("error: %v", err)
 			return false
 		}
 		if resp.StatusCode != http.StatusOK {
 			log.Printf("Status %v when updating tag '%v' on Docker Hub", resp.StatusCode, tag)
-			b, _ := ioutil.ReadAll(resp.Body)
+			b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxDrain))
 			log.Printf("Given response: %v", string(b))
+			closeBody(resp)
 			return false
 		}
+		closeBody(resp)
 	}
 	return true
 }
+
+const (
+	// HubSourceTag tells Docker Hub to build from a git tag.
+	HubSourceTag = "Tag"
+
+	// HubSourceBranch tells Docker Hub to build from a git branch.
+	HubSourceBranch = "Branch"
+)
+
+// dockerHubTrigger triggers builds on Docker Hub. If a trigger URL is given,
+// then the current trigger format is used. Otherwise builds are triggered
+// through the legacy endpoint with the repository and the token.
+type dockerHubTrigger struct {
+	repository string
+	token      string
+	triggerURL string
+	sourceType string
+	sources    map[string]string
+	policy     RetryPolicy
+	client     *http.Client
+}
+
+// newDockerHubTrigger returns a Docker Hub trigger for the given listener. The
+// repository and the token can be set in the options of the trigger. Otherwise
+// the repository of the listener is used, and the token is picked from the
+// service, the tokens of the repositories or the global one, in this order.
+func newDockerHubTrigger(cfg *Configuration, list Listener, tc TriggerConfig) (Trigger, error) {
+	opts := struct {
+		Repository string            `yaml:"repository"`
+		Token      string            `yaml:"token"`
+		TriggerURL string            `yaml:"trigger_url"`
+		SourceType string            `yaml:"source_type"`
+		Sources    map[string]string `yaml:"sources"`
+	}{}
+	if err := tc.decode(&opts); err != nil {
+		return nil, fmt.Errorf("%v service: %v", list.Name, err)
+	}
+
+	if opts.Repository == "" {
+		opts.Repository = list.Repository
+	}
+	if opts.TriggerURL == "" {
+		if opts.Repository == "" {
+			return nil, fmt.Errorf("%v service does not provide a repository!", list.Name)
+		}
+		if opts.SourceType != "" || len(opts.Sources) > 0 {
+			return nil, fmt.Errorf("%v service needs a trigger_url for Docker Hub sources!", list.Name)
+		}
+	} else {
+		u, err := url.Parse(opts.TriggerURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%v service has a bad Docker Hub trigger_url!", list.Name)
+		}
+		switch strings.ToLower(opts.SourceType) {
+		case "", "tag":
+			opts.SourceType = HubSourceTag
+		case "branch":
+			opts.SourceType = HubSourceBranch
+		default:
+			return nil, fmt.Errorf("%v service has an unknown Docker Hub source_type '%v'!", list.Name, opts.SourceType)
+		}
+	}
+	if opts.Token == "" {
+		opts.Token = serviceToken(cfg, list, opts.Repository)
+	}
+	if opts.Token == "" {
+		opts.Token = cfg.Token
+	}
+
+	return &dockerHubTrigger{
+		repository: opts.Repository,
+		token:      opts.Token,
+		triggerURL: opts.TriggerURL,
+		sourceType: opts.SourceType,
+		sources:    opts.Sources,
+		policy:     cfg.Retry,
+		client:     cfg.httpClient(),
+	}, nil
+}
+
+// request returns the request that triggers a build of the given tag.
+func (t *dockerHubTrigger) request(tag string) (*http.Request, error) {
+	if t.triggerURL == "" {
+		return newHubRequest(t.token, t.repository, tag)
+	}
+
+	// Unless told otherwise, the source is named after the tag.
+	source := tag
+	if name, ok := t.sources[tag]; ok {
+		source = name
+	}
+	return newHubSourceRequest(t.triggerURL, t.sourceType, source)
+}
+
+// secrets returns the parts of the requests of this trigger that have to be
+// redacted. For trigger URLs, this is the UUID of the trigger.
+func (t *dockerHubTrigger) secrets() []string {
+	if t.triggerURL == "" {
+		return []string{t.token}
+	}
+
+	parts := strings.Split(strings.Trim(t.triggerURL, "/"), "/")
+	for i, part := range parts {
+		if part == "trigger" && i+1 < len(parts) {
+			return []string{parts[i+1]}
+		}
+	}
+	return []string{t.triggerURL}
+}
+
+// Fire implements the Trigger interface.
+func (t *dockerHubTrigger) Fire(ctx context.Context, ev Event) error {
+	if !pushHub(ctx, t.client, t.policy, ev.Tags, t.request) {
+		return fmt.Errorf("could not update the tags on Docker Hub")
+	}
+	return nil
+}
+
+// Describe implements the Trigger interface.
+func (t *dockerHubTrigger) Describe(ev Event) []string {
+	return describeHubRequests(ev.Tags, t.request, t.secrets()...)
+}
+
+func (t *dockerHubTrigger) String() string {
+	if t.repository == "" {
+		return "Docker Hub trigger"
+	}
+	return "repository '" + t.repository + "'"
+}
+
+// defaultQuayURL is the base URL of Quay.io.
+const defaultQuayURL = "https://quay.io"
+
+// newQuayRequest returns the request that starts a build through the given
+// trigger of a Quay repository with the given parameters.
+func newQuayRequest(apiURL, token, repository, uuid string, params map[string]interface{}) (*http.Request, error) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := apiURL + "/api/v1/repository/" + repository + "/trigger/" + uuid + "/start"
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// quayParameters returns the build parameters for the given tag. Tags without
+// parameters start a build with an empty set of them.
+func quayParameters(parameters map[string]map[string]interface{}, tag string) map[string]interface{} {
+	params, ok := jsonValue(parameters[tag]).(map[string]interface{})
+	if !ok {
+		return map[string]interface{}{}
+	}
+	return params
+}
+
+// jsonValue converts the maps decoded from YAML, which have interface{} keys,
+// into maps that can be encoded into JSON.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			res[k] = jsonValue(val)
+		}
+		return res
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			res[fmt.Sprintf("%v", k)] = jsonValue(val)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, val := range v {
+			res[i] = jsonValue(val)
+		}
+		return res
+	}
+	return value
+}
+
+func updateQuay(ctx context.Context, t *quayTrigger, tags []string) bool {
+	for _, tag := range tags {
+		params := quayParameters(t.parameters, tag)
+		what := "tag '" + tag + "' on Quay"
+		resp, err := doWithRetry(ctx, t.client, t.policy, what, func() (*http.Request, error) {
+			return newQuayRequest(t.apiURL, t.token, t.repository, t.uuid, params)
+		})
+		if err != nil {
+			log.Printf("error: %v", err)
+			return false
+		}
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxDrain))
+		closeBody(resp)
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+			log.Printf("Status %v when starting a build for tag '%v' on Quay", resp.StatusCode, tag)
+			log.Printf("Given response: %v", string(b))
+			return false
+		}
+		log.Printf("Started a build for tag '%v' on Quay repository '%v'", tag, t.repository)
+	}
+	return true
+}
+
+// quayTrigger starts builds through a build trigger of a Quay repository.
+type quayTrigger struct {
+	apiURL     string
+	repository string
+	uuid       string
+	token      string
+	parameters map[string]map[string]interface{}
+	policy     RetryPolicy
+	client     *http.Client
+}
+
+// newQuayTrigger returns a Quay trigger for the given listener. The repository
+// defaults to the one of the listener, and the token to the one of either the
+// service or the repository.
+func newQuayTrigger(cfg *Configuration, list Listener, tc TriggerConfig) (Trigger, error) {
+	opts := struct {
+		APIURL      string                            `yaml:"api_url"`
+		Repository  string                            `yaml:"repository"`
+		TriggerUUID string                            `yaml:"trigger_uuid"`
+		Token       string                            `yaml:"token"`
+		Parameters  map[string]map[string]interface{} `yaml:"parameters"`
+	}{}
+	if err := tc.decode(&opts); err != nil {
+		return nil, fmt.Errorf("%v service: %v", list.Name, err)
+	}
+
+	if opts.APIURL == "" {
+		opts.APIURL = defaultQuayURL
+	}
+	if opts.Repository == "" {
+		opts.Repository = list.Repository
+	}
+	if opts.Repository == "" {
+		return nil, fmt.Errorf("%v service does not provide a repository!", list.Name)
+	}
+	if opts.TriggerUUID == "" {
+		return nil, fmt.Errorf("%v service does not provide a Quay trigger_uuid!", list.Name)
+	}
+	if opts.Token == "" {
+		opts.Token = serviceToken(cfg, list, opts.Repository)
+	}
+	if opts.Token == "" {
+		return nil, fmt.Errorf("%v service does not provide a Quay token!", list.Name)
+	}
+	for tag := range opts.Parameters {
+		if !contains(list.Tags, tag) {
+			return nil, fmt.Errorf("%v service has Quay parameters for the unknown tag '%v'!", list.Name, tag)
+		}
+	}
+
+	return &quayTrigger{
+		apiURL:     strings.TrimSuffix(opts.APIURL, "/"),
+		repository: opts.Repository,
+		uuid:       opts.TriggerUUID,
+		token:      opts.Token,
+		parameters: opts.Parameters,
+		policy:     cfg.Retry,
+		client:     cfg.httpClient(),
+	}, nil
+}
+
+// Fire implements the Trigger interface.
+func (t *quayTrigger) Fire(ctx context.Context, ev Event) error {
+	if !updateQuay(ctx, t, ev.Tags) {
+		return fmt.Errorf("could not start the builds on Quay")
+	}
+	return nil
+}
+
+// Describe implements the Trigger interface.
+func (t *quayTrigger) Describe(ev Event) []string {
+	res := []string{}
+	for _, tag := range ev.Tags {
+		req, err := newQuayRequest(t.apiURL, t.token, t.repository, t.uuid, quayParameters(t.parameters, tag))
+		if err != nil {
+			res = append(res, "error: "+err.Error())
+			continue
+		}
+		res = append(res, describeRequest(req, t.token))
+	}
+	return res
+}
+
+func (t *quayTrigger) String() string {
+	return "Quay repository '" + t.repository + "'"
+}
+
+// contains returns true if the given slice contains the given string.
+func contains(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// sendTrigger performs with the given client the request returned by
+// `newRequest` as described in doWithRetry, and returns an error unless the
+// response has a 2xx status code. The body of the response is always consumed
+// and closed.
+func sendTrigger(ctx context.Context, client *http.Client, policy RetryPolicy, what string,
+	newRequest func() (*http.Request, error)) error {
+
+	resp, err := doWithRetry(ctx, client, policy, what, newRequest)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %v when triggering %v: %v", resp.StatusCode, what, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
@@ -17,6 +17,7 @@ package lib
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -24,6 +25,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -34,11 +36,28 @@ type testOptions struct {
 	decodeError bool
 	tagsPushed  string
 	n           int
+
+	// State and dirtiness of the repository as reported by `_result`.
+	state string
+	dirty bool
+
+	// Test servers handle requests concurrently.
+	mutex sync.Mutex
+}
+
+// pushed returns the tags that have been pushed so far.
+func (opts *testOptions) pushed() string {
+	opts.mutex.Lock()
+	defer opts.mutex.Unlock()
+
+	return opts.tagsPushed
 }
 
 func testOBS(opts *testOptions) *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		opts.mutex.Lock()
 		opts.n = opts.n + 1
+		opts.mutex.Unlock()
 
 		if !strings.HasPrefix(r.URL.String(), "/build") {
 			return
@@ -64,12 +83,29 @@ func testOBS(opts *testOptions) *httptest.Server {
 			return
 		}
 
-		if strings.HasSuffix(r.URL.String(), "/_status") {
+		if strings.HasSuffix(r.URL.Path, "/_result") {
+			opts.mutex.Lock()
+			state, dirty := opts.state, opts.dirty
+			opts.mutex.Unlock()
+			if state == "" {
+				state = "published"
+			}
+			q := r.URL.Query()
+
+			w.WriteHeader(200)
+			fmt.Fprintf(w, "<resultlist><result repository=\"other\" arch=\"%v\" state=\"building\" />", q.Get("arch"))
+			fmt.Fprintf(w, "<result repository=\"%v\" arch=\"%v\" state=\"%v\"", q.Get("repository"), q.Get("arch"), state)
+			if dirty {
+				fmt.Fprint(w, " dirty=\"true\"")
+			}
+			fmt.Fprint(w, "><status package=\"portus\" code=\"succeeded\" /></result></resultlist>")
+		} else if strings.HasSuffix(r.URL.String(), "/_status") {
 			w.WriteHeader(200)
 			fmt.Fprint(w, "<status package=\"portus\" code=\"succeeded\" />")
 		} else if strings.HasSuffix(r.URL.String(), "/_buildinfo") {
 			w.WriteHeader(200)
-			fmt.Fprint(w, "<buildinfo><rev>1234</rev></buildinfo>")
+			fmt.Fprint(w, "<buildinfo><rev>1234</rev><versrel>2.4.0-1.1</versrel>"+
+				"<bcnt>1</bcnt><release>lp150.1.1</release></buildinfo>")
 		}
 	}))
 }
@@ -104,7 +140,9 @@ func testHub(opts *testOptions) *httptest.Server {
 		}
 
 		str := getFromBody(r)
+		opts.mutex.Lock()
 		opts.tagsPushed = opts.tagsPushed + "-" + str
+		opts.mutex.Unlock()
 
 		w.WriteHeader(200)
 	}))
@@ -118,7 +156,7 @@ func TestStatusSucceededOK(t *testing.T) {
 	})
 	defer server.Close()
 
-	res := statusSucceeded(&Configuration{
+	res := statusSucceeded(context.Background(), &Configuration{
 		Server:   server.URL,
 		User:     "user",
 		Password: "password",
@@ -147,7 +185,7 @@ func TestStatusSucceededTimeout(t *testing.T) {
 	defer server.Close()
 	dockerHub = server.URL + "/"
 
-	res := statusSucceeded(&Configuration{
+	res := statusSucceeded(context.Background(), &Configuration{
 		Server:   server.URL,
 		User:     "user",
 		Password: "password",
@@ -157,7 +195,7 @@ func TestStatusSucceededTimeout(t *testing.T) {
 	}
 
 	logged := buf.String()
-	if !strings.Contains(logged, "request canceled") {
+	if !strings.Contains(logged, "Client.Timeout exceeded") {
 		t.Fatalf("Wrong log")
 	}
 }
@@ -174,7 +212,7 @@ func TestStatusSucceededBadRequest(t *testing.T) {
 	})
 	defer server.Close()
 
-	res := statusSucceeded(&Configuration{
+	res := statusSucceeded(context.Background(), &Configuration{
 		Server:   server.URL,
 		User:     "user",
 		Password: "password",
@@ -202,7 +240,7 @@ func TestStatusSucceededBadXML(t *testing.T) {
 	})
 	defer server.Close()
 
-	res := statusSucceeded(&Configuration{
+	res := statusSucceeded(context.Background(), &Configuration{
 		Server:   server.URL,
 		User:     "user",
 		Password: "password",
@@ -226,7 +264,7 @@ func TestFetchRevisionOK(t *testing.T) {
 	})
 	defer server.Close()
 
-	res := fetchRevision(&Configuration{
+	res := fetchRevision(context.Background(), &Configuration{
 		Server:   server.URL,
 		User:     "user",
 		Password: "password",
@@ -237,6 +275,24 @@ func TestFetchRevisionOK(t *testing.T) {
 	}
 }
 
+func TestFetchBuildInfoOK(t *testing.T) {
+	server := testOBS(&testOptions{})
+	defer server.Close()
+
+	info := fetchBuildInfo(context.Background(), &Configuration{
+		Server:   server.URL,
+		User:     "user",
+		Password: "password",
+	}, Listener{})
+
+	if info == nil {
+		t.Fatalf("Expecting to be OK")
+	}
+	assertString(t, "1234", info.Revision)
+	assertString(t, "2.4.0", info.version())
+	assertString(t, "lp150.1.1", info.Release)
+}
+
 func TestFetchRevisionBadRequest(t *testing.T) {
 	var buf bytes.Buffer
 	log.SetOutput(&buf)
@@ -249,7 +305,7 @@ func TestFetchRevisionBadRequest(t *testing.T) {
 	})
 	defer server.Close()
 
-	res := fetchRevision(&Configuration{
+	res := fetchRevision(context.Background(), &Configuration{
 		Server:   server.URL,
 		User:     "user",
 		Password: "password",
@@ -277,7 +333,7 @@ func TestFetchRevisionBadXML(t *testing.T) {
 	})
 	defer server.Close()
 
-	res := fetchRevision(&Configuration{
+	res := fetchRevision(context.Background(), &Configuration{
 		Server:   server.URL,
 		User:     "user",
 		Password: "password",
@@ -293,6 +349,17 @@ func TestFetchRevisionBadXML(t *testing.T) {
 	}
 }
 
+// testHubTrigger returns a Docker Hub trigger for the "example/repo"
+// repository, which uses the legacy endpoint and the given retry policy.
+func testHubTrigger(t *testing.T, policy RetryPolicy) Trigger {
+	cfg := &Configuration{Token: "1234", Retry: policy}
+	trigger, err := newDockerHubTrigger(cfg, Listener{Name: "repo", Repository: "example/repo"}, TriggerConfig{})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	return trigger
+}
+
 func TestHubOK(t *testing.T) {
 	opts := &testOptions{
 		fail:    false,
@@ -302,11 +369,11 @@ func TestHubOK(t *testing.T) {
 	defer server.Close()
 	dockerHub = server.URL + "/"
 
-	res := updateHub("1234", "example/repo", []string{"latest", "one"})
-	if !res {
-		t.Fatalf("Expecting to be OK")
+	err := testHubTrigger(t, RetryPolicy{}).Fire(context.Background(), Event{Tags: []string{"latest", "one"}})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
 	}
-	if opts.tagsPushed != "-latest-one" {
+	if opts.pushed() != "-latest-one" {
 		t.Fatalf("Not all tags were pushed")
 	}
 }
@@ -328,13 +395,13 @@ func TestHubTimeout(t *testing.T) {
 	defer server.Close()
 	dockerHub = server.URL + "/"
 
-	res := updateHub("1234", "example/repo", []string{"latest", "one"})
-	if res {
-		t.Fatalf("Expecting NOT to be OK")
+	err := testHubTrigger(t, RetryPolicy{}).Fire(context.Background(), Event{Tags: []string{"latest", "one"}})
+	if err == nil {
+		t.Fatalf("Expecting errors")
 	}
 
 	logged := buf.String()
-	if !strings.Contains(logged, "request canceled") {
+	if !strings.Contains(logged, "Client.Timeout exceeded") {
 		t.Fatalf("Wrong log")
 	}
 }
@@ -352,9 +419,9 @@ func TestHubBadRequest(t *testing.T) {
 	defer server.Close()
 	dockerHub = server.URL + "/"
 
-	res := updateHub("1234", "example/repo", []string{"latest", "one"})
-	if res {
-		t.Fatalf("Expecting NOT to be OK")
+	err := testHubTrigger(t, RetryPolicy{}).Fire(context.Background(), Event{Tags: []string{"latest", "one"}})
+	if err == nil {
+		t.Fatalf("Expecting errors")
 	}
 
 	logged := buf.String()
@@ -362,3 +429,318 @@ func TestHubBadRequest(t *testing.T) {
 		t.Fatalf("Wrong log")
 	}
 }
+
+func TestDescribeHub(t *testing.T) {
+	dockerHub = "https://registry.hub.docker.com/u/"
+
+	res := testHubTrigger(t, RetryPolicy{}).Describe(Event{Tags: []string{"latest", "one"}})
+	if len(res) != 2 {
+		t.Fatalf("Expecting two requests, got %v", len(res))
+	}
+	assertString(t, "POST https://registry.hub.docker.com/u/example/repo/trigger/***/ "+
+		"Content-Type: application/json {\"docker_tag\": \"latest\"}", res[0])
+	assertString(t, "POST https://registry.hub.docker.com/u/example/repo/trigger/***/ "+
+		"Content-Type: application/json {\"docker_tag\": \"one\"}", res[1])
+}
+
+// testHubSource returns a server which accepts builds from the current Docker
+// Hub trigger URLs, and records the source type and name of each of them.
+func testHubSource(opts *testOptions) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/build/v1/source/source-uuid/trigger/trigger-uuid/call/" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if opts.fail {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		payload := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		opts.mutex.Lock()
+		opts.tagsPushed = opts.tagsPushed + "-" + payload["source_type"] + ":" + payload["source_name"]
+		opts.mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// hubSourceDefaults returns the minimal options of a Docker Hub trigger which
+// uses the trigger URL from the given server.
+func hubSourceDefaults(url string) map[string]interface{} {
+	return map[string]interface{}{
+		"trigger_url": url + "/api/build/v1/source/source-uuid/trigger/trigger-uuid/call/",
+	}
+}
+
+func TestHubTriggerURL(t *testing.T) {
+	opts := &testOptions{}
+	server := testHubSource(opts)
+	defer server.Close()
+
+	trigger, err := newDockerHubTrigger(&Configuration{}, Listener{Name: "portus-head"}, triggerConfig("dockerhub", hubSourceDefaults(server.URL), nil))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := trigger.Fire(context.Background(), Event{Tags: []string{"2.3", "latest"}}); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if opts.pushed() != "-Tag:2.3-Tag:latest" {
+		t.Fatalf("Wrong sources: %v", opts.pushed())
+	}
+	assertString(t, "Docker Hub trigger", trigger.String())
+}
+
+func TestHubTriggerURLBranches(t *testing.T) {
+	opts := &testOptions{}
+	server := testHubSource(opts)
+	defer server.Close()
+
+	trigger, err := newDockerHubTrigger(&Configuration{}, Listener{Name: "portus-head", Repository: "opensuse/portus"},
+		triggerConfig("dockerhub", hubSourceDefaults(server.URL), map[string]interface{}{
+			"source_type": "branch",
+			"sources":     map[interface{}]interface{}{"head": "master"},
+		}))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := trigger.Fire(context.Background(), Event{Tags: []string{"head", "v2.3"}}); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if opts.pushed() != "-Branch:master-Branch:v2.3" {
+		t.Fatalf("Wrong sources: %v", opts.pushed())
+	}
+	assertString(t, "repository 'opensuse/portus'", trigger.String())
+}
+
+func TestHubTriggerURLFails(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	opts := &testOptions{fail: true}
+	server := testHubSource(opts)
+	defer server.Close()
+
+	trigger, err := newDockerHubTrigger(&Configuration{}, Listener{Name: "portus-head"}, triggerConfig("dockerhub", hubSourceDefaults(server.URL), nil))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := trigger.Fire(context.Background(), Event{Tags: []string{"latest"}}); err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	if !strings.Contains(buf.String(), "Status 401 when updating tag 'latest' on Docker Hub") {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestDescribeHubTriggerURL(t *testing.T) {
+	tc := triggerConfig("dockerhub", hubSourceDefaults("https://hub.docker.com"), nil)
+	testTriggerDescribe(t, newDockerHubTrigger, Listener{Name: "portus-head"}, tc, Event{Tags: []string{"latest"}}, []string{
+		"POST https://hub.docker.com/api/build/v1/source/source-uuid/trigger/***/call/ " +
+			`Content-Type: application/json {"source_name":"latest","source_type":"Tag"}`,
+	})
+}
+
+func TestHubBadConfiguration(t *testing.T) {
+	list := Listener{Name: "portus-head", Repository: "opensuse/portus"}
+	testBadTriggerConfiguration(t, newDockerHubTrigger, list, "dockerhub", nil, []badTriggerConfiguration{
+		{map[string]interface{}{"trigger_url": "/api/build"}, "portus-head service has a bad Docker Hub trigger_url!"},
+		{
+			map[string]interface{}{"trigger_url": "https://hub.docker.com/api", "source_type": "commit"},
+			"portus-head service has an unknown Docker Hub source_type 'commit'!",
+		},
+		{map[string]interface{}{"source_type": "branch"}, "portus-head service needs a trigger_url for Docker Hub sources!"},
+	})
+}
+
+func testQuay(opts *testOptions) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/repository/example/repo/trigger/uuid/start" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if opts.fail || r.Header.Get("Authorization") != "Bearer 1234" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error": "forbidden"}`)
+			return
+		}
+
+		params := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&params)
+		opts.mutex.Lock()
+		opts.tagsPushed = opts.tagsPushed + "-" + fmt.Sprintf("%v", params["branch_name"])
+		opts.mutex.Unlock()
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+}
+
+func testQuayTrigger(t *testing.T, url string) Trigger {
+	trigger, err := newQuayTrigger(&Configuration{}, Listener{
+		Name:       "portus-head",
+		Repository: "example/repo",
+		Tags:       []string{"latest", "one"},
+	}, TriggerConfig{
+		Type: "quay",
+		Options: map[string]interface{}{
+			"api_url":      url,
+			"trigger_uuid": "uuid",
+			"token":        "1234",
+			"parameters": map[interface{}]interface{}{
+				"latest": map[interface{}]interface{}{"branch_name": "master"},
+				"one":    map[interface{}]interface{}{"branch_name": "v1"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	return trigger
+}
+
+func TestQuayOK(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	opts := &testOptions{}
+	server := testQuay(opts)
+	defer server.Close()
+
+	trigger := testQuayTrigger(t, server.URL)
+	if err := trigger.Fire(context.Background(), Event{Tags: []string{"latest", "one"}}); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if opts.pushed() != "-master-v1" {
+		t.Fatalf("Not all tags were pushed")
+	}
+
+	logged := buf.String()
+	if !strings.Contains(logged, "Started a build for tag 'latest' on Quay repository 'example/repo'") {
+		t.Fatalf("Wrong log")
+	}
+	if !strings.Contains(logged, "Started a build for tag 'one' on Quay repository 'example/repo'") {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestQuayBadRequest(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	opts := &testOptions{fail: true}
+	server := testQuay(opts)
+	defer server.Close()
+
+	trigger := testQuayTrigger(t, server.URL)
+	if err := trigger.Fire(context.Background(), Event{Tags: []string{"latest", "one"}}); err == nil {
+		t.Fatalf("Expecting errors")
+	}
+
+	logged := buf.String()
+	if !strings.Contains(logged, "Status 403 when starting a build for tag 'latest' on Quay") {
+		t.Fatalf("Wrong log")
+	}
+	if !strings.Contains(logged, `Given response: {"error": "forbidden"}`) {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestDescribeQuay(t *testing.T) {
+	trigger := testQuayTrigger(t, "")
+
+	res := trigger.Describe(Event{Tags: []string{"latest", "two"}})
+	assertSlice(t, []string{
+		"POST https://quay.io/api/v1/repository/example/repo/trigger/uuid/start " +
+			"Authorization: Bearer *** Content-Type: application/json {\"branch_name\":\"master\"}",
+		"POST https://quay.io/api/v1/repository/example/repo/trigger/uuid/start " +
+			"Authorization: Bearer *** Content-Type: application/json {}",
+	}, res)
+}
+
+func TestQuayBadConfiguration(t *testing.T) {
+	list := Listener{Name: "portus-head", Repository: "example/repo", Tags: []string{"latest"}}
+	testBadTriggerConfiguration(t, newQuayTrigger, list, "quay", nil, []badTriggerConfiguration{
+		{map[string]interface{}{"token": "1234"}, "portus-head service does not provide a Quay trigger_uuid!"},
+		{map[string]interface{}{"trigger_uuid": "uuid"}, "portus-head service does not provide a Quay token!"},
+		{
+			map[string]interface{}{
+				"trigger_uuid": "uuid",
+				"token":        "1234",
+				"parameters":   map[interface{}]interface{}{"head": map[interface{}]interface{}{}},
+			},
+			"portus-head service has Quay parameters for the unknown tag 'head'!",
+		},
+	})
+}
+
+func testRepositoryPublished(t *testing.T, opts *testOptions) (bool, string) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	server := testOBS(opts)
+	defer server.Close()
+
+	res := repositoryPublished(context.Background(), &Configuration{
+		Server:   server.URL,
+		User:     "user",
+		Password: "password",
+	}, Listener{
+		Name:         "portus-head",
+		Project:      "Virtualization:containers:Portus",
+		Distribution: "openSUSE_Leap_15.0",
+		Architecture: "x86_64",
+		Package:      "portus",
+	})
+	return res, buf.String()
+}
+
+func TestRepositoryPublishedOK(t *testing.T) {
+	res, _ := testRepositoryPublished(t, &testOptions{})
+	if !res {
+		t.Fatalf("Expecting to be OK")
+	}
+}
+
+func TestRepositoryPublishedPublishing(t *testing.T) {
+	res, logged := testRepositoryPublished(t, &testOptions{state: "publishing"})
+	if res {
+		t.Fatalf("Expecting NOT to be OK")
+	}
+	if !strings.Contains(logged, "portus-head: repository is still being published (publishing), waiting...") {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestRepositoryPublishedDirty(t *testing.T) {
+	res, logged := testRepositoryPublished(t, &testOptions{dirty: true})
+	if res {
+		t.Fatalf("Expecting NOT to be OK")
+	}
+	if !strings.Contains(logged, "(published, dirty)") {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestRepositoryPublishedBadRequest(t *testing.T) {
+	res, logged := testRepositoryPublished(t, &testOptions{fail: true})
+	if res {
+		t.Fatalf("Expecting NOT to be OK")
+	}
+	if !strings.Contains(logged, "Status 401 when checking the result") {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestRepositoryPublishedBadXML(t *testing.T) {
+	res, logged := testRepositoryPublished(t, &testOptions{decodeError: true})
+	if res {
+		t.Fatalf("Expecting NOT to be OK")
+	}
+	if !strings.Contains(logged, "XML syntax error") {
+		t.Fatalf("Wrong log")
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultBackoff is the delay before the first retry if the configuration
+	// does not specify one.
+	defaultBackoff = 1 * time.Second
+
+	// defaultMaxBackoff is the maximum delay between retries if the
+	// configuration does not specify one.
+	defaultMaxBackoff = 1 * time.Minute
+)
+
+// RetryPolicy defines how failed requests are retried. Requests are retried on
+// network errors and on responses with either a 429 or a 5xx status code.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts for each request. Values
+	// lower than two disable retries.
+	Attempts int `yaml:"attempts"`
+
+	// Backoff is the delay before the first retry. It is doubled on each
+	// subsequent retry, and some random jitter is applied to it.
+	Backoff time.Duration `yaml:"backoff"`
+
+	// MaxBackoff is the maximum delay between two attempts.
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+// validate returns an error if the policy has invalid values.
+func (p RetryPolicy) validate() error {
+	if p.Attempts < 0 || p.Backoff < 0 || p.MaxBackoff < 0 {
+		return fmt.Errorf("the retry policy cannot have negative values")
+	}
+	return nil
+}
+
+// delay returns how long to wait after the given failed attempt. The
+// `Retry-After` header from the given response is honored if present. It
+// returns false if this header asks to wait beyond the maximum backoff, in
+// which case the request should not be retried.
+func (p RetryPolicy) delay(attempt int, resp *http.Response) (time.Duration, bool) {
+	backoff, max := p.Backoff, p.MaxBackoff
+	if backoff == 0 {
+		backoff = defaultBackoff
+	}
+	if max == 0 {
+		max = defaultMaxBackoff
+	}
+
+	if d, ok := retryAfter(resp); ok {
+		return d, d <= max
+	}
+
+	d := backoff
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	// Apply jitter so clients do not retry all at once: the final delay is
+	// somewhere between half and the full computed delay.
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1)), true
+}
+
+// retryAfter returns the delay as requested by the `Retry-After` header on
+// 429 and 503 responses. The header can either contain the number of seconds
+// to wait or an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		d := time.Until(date)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// retriable returns true if a request that got the given response or error
+// should be retried.
+func retriable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// doWithRetry performs the request returned by `newRequest` with the given
+// client, retrying it as defined by the given policy. The `newRequest`
+// function is called for each attempt, so request bodies are never reused. The
+// `what` argument describes the request on logs and errors, which never
+// contain the URL of the request since it might have secrets in it.
+func doWithRetry(ctx context.Context, client *http.Client, policy RetryPolicy, what string,
+	newRequest func() (*http.Request, error)) (*http.Response, error) {
+
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if ctx.Err() != nil {
+			if err == nil {
+				closeBody(resp)
+			}
+			return nil, ctx.Err()
+		}
+		if ue, ok := err.(*url.Error); ok {
+			err = fmt.Errorf("%v request for %v: %v", ue.Op, what, ue.Err)
+		}
+		if attempt >= policy.Attempts || !retriable(resp, err) {
+			return resp, err
+		}
+
+		delay, ok := policy.delay(attempt, resp)
+		if !ok {
+			log.Printf("Attempt %v/%v for %v got status %v; not retrying since it asks to wait %v",
+				attempt, policy.Attempts, what, resp.StatusCode, delay)
+			return resp, nil
+		}
+		if err != nil {
+			log.Printf("Attempt %v/%v for %v failed: %v; retrying in %v",
+				attempt, policy.Attempts, what, err, delay)
+		} else {
+			log.Printf("Attempt %v/%v for %v got status %v; retrying in %v",
+				attempt, policy.Attempts, what, resp.StatusCode, delay)
+			closeBody(resp)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
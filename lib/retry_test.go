@@ -0,0 +1,319 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer returns a server that responds with the given status code to the
+// first `failures` requests, and then delegates into the given handler.
+func flakyServer(failures, status int, retryAfter string, handler http.Handler) (*httptest.Server, *int) {
+	var mutex sync.Mutex
+	n := 0
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		n++
+		current := n
+		mutex.Unlock()
+
+		if current <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})), &n
+}
+
+var fastRetries = RetryPolicy{
+	Attempts:   3,
+	Backoff:    time.Millisecond,
+	MaxBackoff: 5 * time.Millisecond,
+}
+
+func TestRetryOBS(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+	server, n := flakyServer(2, http.StatusBadGateway, "", obs.Config.Handler)
+	defer server.Close()
+
+	res := fetchRevision(context.Background(), &Configuration{
+		Server:   server.URL,
+		User:     "user",
+		Password: "password",
+		Retry:    fastRetries,
+	}, Listener{})
+
+	assertString(t, "1234", res)
+	if *n != 3 {
+		t.Fatalf("Expecting 3 attempts, got %v", *n)
+	}
+	logged := buf.String()
+	if !strings.Contains(logged, "Attempt 1/3 for /build/_buildinfo got status 502") {
+		t.Fatalf("Wrong log")
+	}
+	if !strings.Contains(logged, "Attempt 2/3 for /build/_buildinfo got status 502") {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestRetryOBSGivesUp(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+	server, n := flakyServer(5, http.StatusServiceUnavailable, "", obs.Config.Handler)
+	defer server.Close()
+
+	res := statusSucceeded(context.Background(), &Configuration{
+		Server:   server.URL,
+		User:     "user",
+		Password: "password",
+		Retry:    fastRetries,
+	}, Listener{})
+
+	if res {
+		t.Fatalf("Expecting NOT to be OK")
+	}
+	if *n != 3 {
+		t.Fatalf("Expecting 3 attempts, got %v", *n)
+	}
+	if !strings.Contains(buf.String(), "Status 503 when checking the status") {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestRetryDoesNotRetryClientErrors(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	opts := &testOptions{}
+	hub := testHub(opts)
+	defer hub.Close()
+	server, n := flakyServer(5, http.StatusUnauthorized, "", hub.Config.Handler)
+	defer server.Close()
+	dockerHub = server.URL + "/"
+
+	if testHubTrigger(t, fastRetries).Fire(context.Background(), Event{Tags: []string{"latest"}}) == nil {
+		t.Fatalf("Expecting errors")
+	}
+	if *n != 1 {
+		t.Fatalf("Expecting 1 attempt, got %v", *n)
+	}
+}
+
+func TestRetryHubRetryAfter(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	opts := &testOptions{}
+	hub := testHub(opts)
+	defer hub.Close()
+	server, n := flakyServer(1, http.StatusTooManyRequests, "1", hub.Config.Handler)
+	defer server.Close()
+	dockerHub = server.URL + "/"
+
+	policy := fastRetries
+	policy.MaxBackoff = 2 * time.Second
+	start := time.Now()
+	err := testHubTrigger(t, policy).Fire(context.Background(), Event{Tags: []string{"latest", "one"}})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if time.Since(start) < time.Second {
+		t.Fatalf("Expecting to honor the Retry-After header")
+	}
+	if *n != 3 {
+		t.Fatalf("Expecting 3 requests, got %v", *n)
+	}
+	if opts.pushed() != "-latest-one" {
+		t.Fatalf("Not all tags were pushed")
+	}
+	if !strings.Contains(buf.String(), "Attempt 1/3 for tag 'latest' on Docker Hub got status 429; retrying in 1s") {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestRetryHubRetryAfterTooLong(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	opts := &testOptions{}
+	hub := testHub(opts)
+	defer hub.Close()
+	server, n := flakyServer(1, http.StatusServiceUnavailable, "3600", hub.Config.Handler)
+	defer server.Close()
+	dockerHub = server.URL + "/"
+
+	if testHubTrigger(t, fastRetries).Fire(context.Background(), Event{Tags: []string{"latest"}}) == nil {
+		t.Fatalf("Expecting errors")
+	}
+	if *n != 1 {
+		t.Fatalf("Expecting 1 attempt, got %v", *n)
+	}
+	if !strings.Contains(buf.String(), "Attempt 1/3 for tag 'latest' on Docker Hub got status 503; not retrying since it asks to wait 1h0m0s") {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	server, _ := flakyServer(5, http.StatusServiceUnavailable, "", http.NotFoundHandler())
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	policy := RetryPolicy{Attempts: 3, Backoff: time.Minute, MaxBackoff: time.Minute}
+	_, err := doWithRetry(ctx, http.DefaultClient, policy, "test", func() (*http.Request, error) {
+		return http.NewRequest("GET", server.URL, nil)
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expecting the context to be done, got: %v", err)
+	}
+}
+
+func TestRetryCanceledRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	resp, err := doWithRetry(ctx, http.DefaultClient, fastRetries, "test", func() (*http.Request, error) {
+		return http.NewRequest("GET", server.URL, nil)
+	})
+	if resp != nil || err != context.DeadlineExceeded {
+		t.Fatalf("Expecting the context to be done, got: %v", err)
+	}
+}
+
+func TestRetryRedactsErrors(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	_, err := doWithRetry(context.Background(), http.DefaultClient, fastRetries, "test", func() (*http.Request, error) {
+		return http.NewRequest("GET", server.URL+"/trigger/secret/?token=secret", nil)
+	})
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	if !strings.HasPrefix(err.Error(), "Get request for test: ") {
+		t.Fatalf("Wrong error: %v", err)
+	}
+	if strings.Contains(err.Error(), "secret") || strings.Contains(buf.String(), "secret") {
+		t.Fatalf("Secrets were leaked")
+	}
+	if !strings.Contains(buf.String(), "Attempt 1/3 for test failed: Get request for test: ") {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	for _, c := range []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 200 * time.Millisecond, 400 * time.Millisecond},
+		{10, 500 * time.Millisecond, time.Second},
+	} {
+		d, ok := policy.delay(c.attempt, nil)
+		if !ok || d < c.min || d > c.max {
+			t.Fatalf("Attempt %v: expecting a delay between %v and %v, got %v", c.attempt, c.min, c.max, d)
+		}
+	}
+}
+
+func TestRetryPolicyDelayRetryAfter(t *testing.T) {
+	policy := RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Minute}
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+
+	resp.Header.Set("Retry-After", "3")
+	if d, ok := policy.delay(1, resp); !ok || d != 3*time.Second {
+		t.Fatalf("Expecting to wait 3s, got %v", d)
+	}
+
+	// Retry-After cannot hold a worker beyond the maximum backoff.
+	resp.Header.Set("Retry-After", "86400")
+	if _, ok := policy.delay(1, resp); ok {
+		t.Fatalf("Expecting not to retry")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}}
+
+	if _, ok := retryAfter(resp); ok {
+		t.Fatalf("Expecting no Retry-After")
+	}
+
+	resp.Header.Set("Retry-After", "3")
+	if d, ok := retryAfter(resp); !ok || d != 3*time.Second {
+		t.Fatalf("Expecting 3s, got %v", d)
+	}
+
+	resp.Header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if d, ok := retryAfter(resp); !ok || d < 59*time.Minute {
+		t.Fatalf("Expecting about one hour, got %v", d)
+	}
+
+	resp.Header.Set("Retry-After", "whatever")
+	if _, ok := retryAfter(resp); ok {
+		t.Fatalf("Expecting no Retry-After")
+	}
+
+	resp.StatusCode = http.StatusInternalServerError
+	resp.Header.Set("Retry-After", "3")
+	if _, ok := retryAfter(resp); ok {
+		t.Fatalf("Expecting Retry-After to be ignored")
+	}
+}
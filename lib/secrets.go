@@ -0,0 +1,228 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// SecretFile is the prefix of secrets read from a file.
+	SecretFile = "file:"
+
+	// SecretExec is the prefix of secrets printed by a helper command.
+	SecretExec = "exec:"
+)
+
+// secretTimeout is the maximum time that a helper command has to print a
+// secret.
+var secretTimeout = 30 * time.Second
+
+// envReference matches references to environment variables like `${NAME}`.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ResolveSecret returns the secret referenced by the given value:
+//
+//   - `file:<path>` is replaced by the contents of the given file.
+//   - `exec:<command> <args>` is replaced by the output of the given command,
+//     which is run without a shell.
+//   - `${NAME}` references are replaced by the value of the given environment
+//     variable. These references are also expanded in the path of files and in
+//     the command line of helper commands.
+//
+// Trailing newlines from files and commands are removed. Any other value is
+// returned as is.
+func ResolveSecret(value string) (string, error) {
+	if strings.HasPrefix(value, SecretFile) {
+		path, err := expandEnv(strings.TrimPrefix(value, SecretFile))
+		if err != nil {
+			return "", err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if strings.HasPrefix(value, SecretExec) {
+		line, err := expandEnv(strings.TrimPrefix(value, SecretExec))
+		if err != nil {
+			return "", err
+		}
+		return secretFromCommand(line)
+	}
+	return expandEnv(value)
+}
+
+// expandEnv replaces the `${NAME}` references from the given value. It
+// returns an error if any of the variables is not set.
+func expandEnv(value string) (string, error) {
+	var err error
+
+	res := envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		val, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable '%v' is not set", name)
+		}
+		return val
+	})
+	return res, err
+}
+
+// secretFromCommand returns the output of the given command line.
+func secretFromCommand(line string) (string, error) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return "", fmt.Errorf("no command given for the secret")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("command '%v' failed: %v: %v", args[0], err, msg)
+		}
+		return "", fmt.Errorf("command '%v' failed: %v", args[0], err)
+	}
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
+
+// resolveSecrets resolves all the secrets from the given credentials.
+func (crd Credentials) resolveSecrets() (Credentials, error) {
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{
+		{"user", &crd.User},
+		{"password", &crd.Password},
+		{"token", &crd.Token},
+		{"OBS token", &crd.Auth.Token},
+	} {
+		val, err := ResolveSecret(*field.value)
+		if err != nil {
+			return crd, fmt.Errorf("could not resolve the %v: %v", field.name, err)
+		}
+		*field.value = val
+	}
+	return crd, nil
+}
+
+// resolveSecrets resolves all the secrets from the given configuration file.
+// That is, the OBS credentials, the trigger tokens and all the string options
+// of triggers.
+func (settings *ConfigFile) resolveSecrets() error {
+	token, err := ResolveSecret(settings.Auth.Token)
+	if err != nil {
+		return fmt.Errorf("could not resolve the OBS token: %v", err)
+	}
+	settings.Auth.Token = token
+
+	for name, srv := range settings.Servers {
+		for _, field := range []struct {
+			name  string
+			value *string
+		}{
+			{"user", &srv.User},
+			{"password", &srv.Password},
+			{"OBS token", &srv.Auth.Token},
+		} {
+			val, err := ResolveSecret(*field.value)
+			if err != nil {
+				return fmt.Errorf("could not resolve the %v of the %v server: %v", field.name, name, err)
+			}
+			*field.value = val
+		}
+		settings.Servers[name] = srv
+	}
+
+	for repo, token := range settings.Tokens {
+		val, err := ResolveSecret(token)
+		if err != nil {
+			return fmt.Errorf("could not resolve the token for '%v': %v", repo, err)
+		}
+		settings.Tokens[repo] = val
+	}
+
+	for name, list := range settings.Services {
+		val, err := ResolveSecret(list.Token)
+		if err != nil {
+			return fmt.Errorf("could not resolve the token of the %v service: %v", name, err)
+		}
+		list.Token = val
+
+		if opt, err := resolveTriggerSecrets(list.Trigger.Options); err != nil {
+			return fmt.Errorf("could not resolve the '%v' trigger option of the %v service: %v", opt, name, err)
+		}
+		settings.Services[name] = list
+	}
+	return nil
+}
+
+// resolveTriggerSecrets resolves the secrets from the options of a trigger
+// that hold credentials: the token, the password of the registry and the
+// values of sensitive headers. Other options are left untouched, since they
+// may reference variables that are only set when the trigger is fired (e.g.
+// `${OPENHUB_TAG}` on the arguments of a command). On error, the name of the
+// option that failed is returned.
+func resolveTriggerSecrets(opts map[string]interface{}) (string, error) {
+	if token, ok := opts["token"].(string); ok {
+		val, err := ResolveSecret(token)
+		if err != nil {
+			return "token", err
+		}
+		opts["token"] = val
+	}
+
+	if registry, ok := opts["registry"].(map[interface{}]interface{}); ok {
+		if password, ok := registry["password"].(string); ok {
+			val, err := ResolveSecret(password)
+			if err != nil {
+				return "registry.password", err
+			}
+			registry["password"] = val
+		}
+	}
+
+	if headers, ok := opts["headers"].(map[interface{}]interface{}); ok {
+		for k, v := range headers {
+			header, ok := v.(string)
+			if !ok || !sensitiveHeader(fmt.Sprintf("%v", k)) {
+				continue
+			}
+			val, err := ResolveSecret(header)
+			if err != nil {
+				return fmt.Sprintf("headers.%v", k), err
+			}
+			headers[k] = val
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,184 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecretPlain(t *testing.T) {
+	for _, value := range []string{"", "password", "pa$$word", "$HOME"} {
+		res, err := ResolveSecret(value)
+		if err != nil {
+			t.Fatalf("Expecting no errors, got: %v", err)
+		}
+		assertString(t, value, res)
+	}
+}
+
+func TestResolveSecretEnv(t *testing.T) {
+	os.Setenv("OPENHUB_TEST_SECRET", "secret")
+	defer os.Unsetenv("OPENHUB_TEST_SECRET")
+
+	res, err := ResolveSecret("my-${OPENHUB_TEST_SECRET}-${OPENHUB_TEST_SECRET}")
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, "my-secret-secret", res)
+
+	_, err = ResolveSecret("${OPENHUB_TEST_UNKNOWN}")
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "environment variable 'OPENHUB_TEST_UNKNOWN' is not set", err.Error())
+}
+
+func TestResolveSecretFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(path, []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("Could not write the secret: %v", err)
+	}
+
+	os.Setenv("OPENHUB_TEST_DIR", dir)
+	defer os.Unsetenv("OPENHUB_TEST_DIR")
+
+	res, err := ResolveSecret("file:${OPENHUB_TEST_DIR}/secret")
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, "secret", res)
+
+	if _, err = ResolveSecret("file:" + filepath.Join(dir, "unknown")); err == nil {
+		t.Fatalf("Expecting errors")
+	}
+}
+
+func TestResolveSecretExec(t *testing.T) {
+	res, err := ResolveSecret("exec:echo secret")
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, "secret", res)
+
+	_, err = ResolveSecret("exec:sh -c exit")
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	_, err = ResolveSecret("exec:ls /openhub/unknown")
+	if err == nil || !strings.HasPrefix(err.Error(), "command 'ls' failed: exit status") {
+		t.Fatalf("Wrong error: %v", err)
+	}
+
+	_, err = ResolveSecret("exec: ")
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "no command given for the secret", err.Error())
+}
+
+func TestParseConfigurationSecrets(t *testing.T) {
+	os.Setenv("OPENHUB_TEST_TOKEN", "first")
+	defer os.Unsetenv("OPENHUB_TEST_TOKEN")
+
+	crd := Credentials{
+		Server:   "https://api.opensuse.org",
+		User:     "exec:echo user",
+		Password: "${OPENHUB_TEST_TOKEN}-password",
+	}
+	cfg, err := ParseConfiguration(getPath("test/secrets.yml"), crd, Options{})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, "user", cfg.User)
+	assertString(t, "first-password", cfg.Password)
+	assertString(t, "first", findListener(t, cfg.Listeners, "portus-head").trigger.(*dockerHubTrigger).token)
+	assertString(t, "first-webhook", findListener(t, cfg.Listeners, "registry").trigger.(*webhookTrigger).headers["X-Ci-Token"])
+
+	// Only credentials are resolved, so variables set by triggers are kept.
+	args := findListener(t, cfg.Listeners, "build").trigger.(*commandTrigger).args
+	assertString(t, "docker build -t img:${OPENHUB_TAG} .", args[1])
+
+	// Secrets are read again on each load, so they can be rotated.
+	os.Setenv("OPENHUB_TEST_TOKEN", "second")
+	cfg, err = ParseConfiguration(getPath("test/secrets.yml"), crd, Options{})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, "second-password", cfg.Password)
+	assertString(t, "second", findListener(t, cfg.Listeners, "portus-head").trigger.(*dockerHubTrigger).token)
+	assertString(t, "second-webhook", findListener(t, cfg.Listeners, "registry").trigger.(*webhookTrigger).headers["X-Ci-Token"])
+}
+
+func TestParseConfigurationSecretsMissing(t *testing.T) {
+	_, err := ParseConfiguration(getPath("test/secrets.yml"), Credentials{}, Options{})
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "could not resolve the token for 'opensuse/portus': "+
+		"environment variable 'OPENHUB_TEST_TOKEN' is not set", err.Error())
+
+	os.Setenv("OPENHUB_TEST_TOKEN", "token")
+	defer os.Unsetenv("OPENHUB_TEST_TOKEN")
+	_, err = ParseConfiguration(getPath("test/secrets.yml"), Credentials{Password: "exec:false"}, Options{})
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "could not resolve the password: command 'false' failed: exit status 1", err.Error())
+}
+
+func TestResolveTriggerSecrets(t *testing.T) {
+	os.Setenv("OPENHUB_TEST_TOKEN", "secret")
+	defer os.Unsetenv("OPENHUB_TEST_TOKEN")
+
+	opts := map[string]interface{}{
+		"token": "${OPENHUB_TEST_TOKEN}",
+		"url":   "https://ci.example.com/${OPENHUB_TAG}",
+		"registry": map[interface{}]interface{}{
+			"username": "${OPENHUB_TAG}",
+			"password": "${OPENHUB_TEST_TOKEN}",
+		},
+		"headers": map[interface{}]interface{}{
+			"Authorization": "Bearer ${OPENHUB_TEST_TOKEN}",
+			"X-Tag":         "${OPENHUB_TAG}",
+		},
+	}
+	if _, err := resolveTriggerSecrets(opts); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	registry := opts["registry"].(map[interface{}]interface{})
+	headers := opts["headers"].(map[interface{}]interface{})
+	assertString(t, "secret", opts["token"].(string))
+	assertString(t, "https://ci.example.com/${OPENHUB_TAG}", opts["url"].(string))
+	assertString(t, "${OPENHUB_TAG}", registry["username"].(string))
+	assertString(t, "secret", registry["password"].(string))
+	assertString(t, "Bearer secret", headers["Authorization"].(string))
+	assertString(t, "${OPENHUB_TAG}", headers["X-Tag"].(string))
+
+	opt, err := resolveTriggerSecrets(map[string]interface{}{
+		"headers": map[interface{}]interface{}{"X-Token": "${OPENHUB_TEST_MISSING}"},
+	})
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "headers.X-Token", opt)
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OBSServer contains the location and the credentials of an OBS instance.
+type OBSServer struct {
+	URL      string        `yaml:"url"`
+	User     string        `yaml:"user"`
+	Password string        `yaml:"password"`
+	Auth     AuthConfig    `yaml:"auth"`
+	Timeout  time.Duration `yaml:"timeout"`
+
+	// TLS and Proxy configure the connections to this server. If no proxy is
+	// given, the one from the environment is used.
+	TLS   TLSConfig `yaml:"tls"`
+	Proxy string    `yaml:"proxy"`
+
+	// client is shared by all the requests to this server.
+	client *http.Client
+}
+
+// timeout returns the timeout for requests to this server.
+func (srv OBSServer) timeout() time.Duration {
+	if srv.Timeout == 0 {
+		return requestTimeout
+	}
+	return srv.Timeout
+}
+
+// httpClient returns the client to be used for requests to this server.
+func (srv OBSServer) httpClient() *http.Client {
+	if srv.client == nil {
+		return newClient(srv.timeout(), nil)
+	}
+	return srv.client
+}
+
+// serverFor returns the OBS server of the given listener. Listeners that do
+// not reference any server use the global one.
+func serverFor(cfg *Configuration, list Listener) (OBSServer, error) {
+	if list.Server == "" {
+		return OBSServer{
+			URL:      cfg.Server,
+			User:     cfg.User,
+			Password: cfg.Password,
+			Auth:     cfg.Auth,
+			TLS:      cfg.TLS,
+			Proxy:    cfg.Proxy,
+			client:   cfg.obsClient,
+		}, nil
+	}
+
+	srv, ok := cfg.Servers[list.Server]
+	if !ok {
+		return srv, fmt.Errorf("unknown server '%v'", list.Server)
+	}
+	return srv, nil
+}
+
+// sanitizeServers validates the servers from the given configuration file.
+// Servers without a user or a password get them from the oscrc file of the
+// given credentials, if any.
+func sanitizeServers(settings ConfigFile, crd Credentials) (map[string]OBSServer, error) {
+	servers := make(map[string]OBSServer)
+
+	for name, srv := range settings.Servers {
+		if srv.URL == "" {
+			return nil, fmt.Errorf("%v server does not provide a url!", name)
+		}
+		srv.URL = strings.TrimSuffix(srv.URL, "/")
+
+		if srv.Timeout < 0 {
+			return nil, fmt.Errorf("%v server has a negative timeout!", name)
+		}
+		if crd.Oscrc != "" && (srv.User == "" || srv.Password == "") {
+			user, password, err := ReadOscrc(crd.Oscrc, srv.URL)
+			if err != nil {
+				return nil, fmt.Errorf("%v server: %v", name, err)
+			}
+			if srv.User == "" {
+				srv.User = user
+			}
+			if srv.Password == "" {
+				srv.Password = password
+			}
+		}
+		if err := srv.Auth.validate(srv.User); err != nil {
+			return nil, fmt.Errorf("%v server: %v", name, err)
+		}
+		transport, err := newTransport(srv.TLS, srv.Proxy, settings.HTTP)
+		if err != nil {
+			return nil, fmt.Errorf("%v server: %v", name, err)
+		}
+		srv.client = newClient(srv.timeout(), transport)
+		servers[name] = srv
+	}
+	return servers, nil
+}
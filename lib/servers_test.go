@@ -0,0 +1,151 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfigurationServers(t *testing.T) {
+	cfg, err := ParseConfiguration(
+		getPath("test/servers.yml"),
+		Credentials{Server: "https://api.opensuse.org", User: "user", Password: "password"},
+		Options{},
+	)
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	srv, err := serverFor(cfg, findListener(t, cfg.Listeners, "portus-head"))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, "https://api.opensuse.org", srv.URL)
+	assertString(t, "user", srv.User)
+	if srv.timeout() != requestTimeout {
+		t.Fatalf("Expecting the default timeout, got %v", srv.timeout())
+	}
+
+	srv, err = serverFor(cfg, findListener(t, cfg.Listeners, "internal"))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, "https://obs.example.com", srv.URL)
+	assertString(t, "internal-user", srv.User)
+	assertString(t, "internal-password", srv.Password)
+	if srv.timeout() != time.Minute {
+		t.Fatalf("Expecting a timeout of one minute, got %v", srv.timeout())
+	}
+
+	assertString(t, AuthToken, cfg.Servers["tokens"].Auth.Type)
+	assertString(t, "my-token", cfg.Servers["tokens"].Auth.Token)
+}
+
+func TestParseConfigurationUnknownServer(t *testing.T) {
+	_, err := ParseConfiguration(getPath("test/badserver.yml"), Credentials{}, Options{})
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "portus-head service references an unknown server 'external'!", err.Error())
+}
+
+func TestSanitizeServers(t *testing.T) {
+	for _, c := range []struct {
+		srv OBSServer
+		err string
+	}{
+		{OBSServer{}, "obs server does not provide a url!"},
+		{OBSServer{URL: "https://obs", Timeout: -time.Second}, "obs server has a negative timeout!"},
+		{
+			OBSServer{URL: "https://obs", Auth: AuthConfig{Type: AuthToken}},
+			"obs server: the token authentication requires an OBS token",
+		},
+	} {
+		_, err := sanitizeServers(ConfigFile{Servers: map[string]OBSServer{"obs": c.srv}}, Credentials{})
+		if err == nil {
+			t.Fatalf("Expecting errors for %v", c.srv)
+		}
+		assertString(t, c.err, err.Error())
+	}
+
+	// Credentials can be picked from the oscrc file.
+	servers, err := sanitizeServers(ConfigFile{Servers: map[string]OBSServer{
+		"obs": {URL: "https://build.example.com"},
+	}}, Credentials{Oscrc: getPath("test/osc/oscrc")})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, "legacy-user", servers["obs"].User)
+	assertString(t, "legacy-password", servers["obs"].Password)
+}
+
+func TestSyncMultipleServers(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+	internal, _ := testAuthOBS(func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Token internal-token"
+	})
+	defer internal.Close()
+
+	public, private := &recordingTrigger{}, &recordingTrigger{}
+	cfg := testShutdownConfiguration(obs.URL, 0)
+	cfg.SingleShot = true
+	cfg.Servers = map[string]OBSServer{
+		"internal": {URL: internal.URL, Auth: AuthConfig{Type: AuthToken, Token: "internal-token"}},
+	}
+	cfg.Listeners[0].trigger = public
+	cfg.Listeners = append(cfg.Listeners, Listener{
+		Name:         "internal",
+		Server:       "internal",
+		Project:      "Devel:Portus",
+		Distribution: "openSUSE_Leap_42.3",
+		Architecture: "x86_64",
+		Package:      "portus",
+		Tags:         []string{"latest"},
+		trigger:      private,
+	})
+
+	if err := Sync(context.Background(), cfg, nil); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if len(public.fired()) != 1 || len(private.fired()) != 1 {
+		t.Fatalf("Expecting both services to be triggered: %v", buf.String())
+	}
+}
+
+func TestListenerIdentityServer(t *testing.T) {
+	list := Listener{Project: "Devel:Portus", Package: "portus"}
+	other := list
+	other.Server = "internal"
+
+	if list.identity() == other.identity() {
+		t.Fatalf("Expecting the server to be part of the identity")
+	}
+	if !strings.HasPrefix(other.identity(), "internal/") {
+		t.Fatalf("Wrong identity: %v", other.identity())
+	}
+}
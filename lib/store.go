@@ -0,0 +1,327 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// JSONStore is the format of a store that keeps all the revisions inside
+	// of a single JSON file.
+	JSONStore = "json"
+
+	// KVStore is the format of a store that keeps the revisions in an
+	// append-only key/value log.
+	KVStore = "kv"
+)
+
+// Store is the interface to be implemented by any backend that persists the
+// last triggered revision of each listener.
+type Store interface {
+	// Load returns all the revisions that have been persisted so far.
+	Load() (map[string]string, error)
+
+	// Set persists the given revision for the listener with the given name.
+	Set(name, revision string) error
+
+	// Delete removes the revision of the listener with the given name.
+	Delete(name string) error
+
+	// Close flushes any pending data and releases the store.
+	Close() error
+}
+
+// OpenStore returns the store for the given format and path. If the given path
+// is empty, then revisions will only be kept in memory.
+func OpenStore(format, path string) (Store, error) {
+	if path == "" {
+		return &memoryStore{}, nil
+	}
+
+	switch format {
+	case "", JSONStore:
+		return openJSONStore(path)
+	case KVStore:
+		return openKVStore(path)
+	}
+	return nil, fmt.Errorf("unknown state format '%v'", format)
+}
+
+// ReadStore returns the revisions persisted in the store with the given format
+// and path, without modifying it in any way.
+func ReadStore(format, path string) (map[string]string, error) {
+	if path == "" {
+		return map[string]string{}, nil
+	}
+
+	switch format {
+	case "", JSONStore:
+		st, err := openJSONStore(path)
+		if err != nil {
+			return nil, err
+		}
+		return st.revisions, nil
+	case KVStore:
+		st := &kvStore{path: path, revisions: make(map[string]string)}
+		if err := st.replay(); err != nil {
+			return nil, err
+		}
+		return st.revisions, nil
+	}
+	return nil, fmt.Errorf("unknown state format '%v'", format)
+}
+
+// memoryStore is a store that does not persist anything.
+type memoryStore struct{}
+
+func (*memoryStore) Load() (map[string]string, error) { return map[string]string{}, nil }
+func (*memoryStore) Set(name, revision string) error  { return nil }
+func (*memoryStore) Delete(name string) error         { return nil }
+func (*memoryStore) Close() error                     { return nil }
+
+// jsonStore keeps all the revisions in a single JSON file, which is rewritten
+// atomically on each change.
+type jsonStore struct {
+	mutex     sync.Mutex
+	path      string
+	revisions map[string]string
+}
+
+func openJSONStore(path string) (*jsonStore, error) {
+	st := &jsonStore{path: path, revisions: make(map[string]string)}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return nil, err
+	}
+	if len(data) == 0 {
+		return st, nil
+	}
+	if err := json.Unmarshal(data, &st.revisions); err != nil {
+		return nil, fmt.Errorf("could not parse state file '%v': %v", path, err)
+	}
+	return st, nil
+}
+
+func (st *jsonStore) Load() (map[string]string, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	return copyRevisions(st.revisions), nil
+}
+
+func (st *jsonStore) Set(name, revision string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.revisions[name] = revision
+	return st.flush()
+}
+
+func (st *jsonStore) Delete(name string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	delete(st.revisions, name)
+	return st.flush()
+}
+
+func (st *jsonStore) Close() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	return st.flush()
+}
+
+func (st *jsonStore) flush() error {
+	data, err := json.MarshalIndent(st.revisions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(st.path, data)
+}
+
+// kvRecord is a single entry of the log kept by the kvStore.
+type kvRecord struct {
+	Key     string `json:"k"`
+	Value   string `json:"v,omitempty"`
+	Deleted bool   `json:"d,omitempty"`
+}
+
+// kvStore is an embedded key/value store backed by an append-only log. Each
+// change is appended and synced to disk, and the log is compacted atomically
+// when opening and closing the store. Incomplete records (e.g. because of a
+// crash in the middle of a write) are skipped when loading.
+type kvStore struct {
+	mutex     sync.Mutex
+	path      string
+	file      *os.File
+	revisions map[string]string
+}
+
+func openKVStore(path string) (*kvStore, error) {
+	st := &kvStore{path: path, revisions: make(map[string]string)}
+
+	if err := st.replay(); err != nil {
+		return nil, err
+	}
+	if err := st.compact(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	st.file = file
+	return st, nil
+}
+
+// replay reads the log and applies all of its complete records.
+func (st *kvStore) replay() error {
+	file, err := os.Open(st.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		rec := kvRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil || rec.Key == "" {
+			continue
+		}
+		if rec.Deleted {
+			delete(st.revisions, rec.Key)
+		} else {
+			st.revisions[rec.Key] = rec.Value
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the log so it only contains one record per key.
+func (st *kvStore) compact() error {
+	data := []byte{}
+	for k, v := range st.revisions {
+		line, err := json.Marshal(kvRecord{Key: k, Value: v})
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	return writeFileAtomic(st.path, data)
+}
+
+func (st *kvStore) Load() (map[string]string, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	return copyRevisions(st.revisions), nil
+}
+
+func (st *kvStore) Set(name, revision string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if err := st.append(kvRecord{Key: name, Value: revision}); err != nil {
+		return err
+	}
+	st.revisions[name] = revision
+	return nil
+}
+
+func (st *kvStore) Delete(name string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if err := st.append(kvRecord{Key: name, Deleted: true}); err != nil {
+		return err
+	}
+	delete(st.revisions, name)
+	return nil
+}
+
+// append writes the given record at the end of the log and syncs it to disk.
+func (st *kvStore) append(rec kvRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := st.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return st.file.Sync()
+}
+
+func (st *kvStore) Close() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if err := st.file.Close(); err != nil {
+		return err
+	}
+	return st.compact()
+}
+
+// writeFileAtomic writes the given data into a temporary file and then renames
+// it into the given path. This way readers either see the old contents or the
+// new ones, but never a partial write.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func copyRevisions(revisions map[string]string) map[string]string {
+	res := make(map[string]string, len(revisions))
+	for k, v := range revisions {
+		res[k] = v
+	}
+	return res
+}
@@ -0,0 +1,192 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "openhub")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	return dir
+}
+
+func testStoreRoundTrip(t *testing.T, format string) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+
+	store, err := OpenStore(format, path)
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := store.Set("portus-head", "1"); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := store.Set("portus-head", "2"); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := store.Set("portus-2.3", "3"); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := store.Set("portus-2.2", "4"); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := store.Delete("portus-2.2"); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	store, err = OpenStore(format, path)
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	defer store.Close()
+
+	revisions, err := store.Load()
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("Expecting 2 revisions, got %v", len(revisions))
+	}
+	assertString(t, "2", revisions["portus-head"])
+	assertString(t, "3", revisions["portus-2.3"])
+}
+
+func TestJSONStoreRoundTrip(t *testing.T) {
+	testStoreRoundTrip(t, JSONStore)
+}
+
+func TestKVStoreRoundTrip(t *testing.T) {
+	testStoreRoundTrip(t, KVStore)
+}
+
+func TestJSONStoreBadFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	ioutil.WriteFile(path, []byte("{"), 0600)
+
+	_, err := OpenStore(JSONStore, path)
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	if !strings.Contains(err.Error(), "could not parse state file") {
+		t.Fatalf("Wrong error: %v", err)
+	}
+}
+
+func TestKVStoreTornWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.kv")
+	ioutil.WriteFile(path, []byte("{\"k\":\"portus-head\",\"v\":\"1\"}\n{\"k\":\"portus-head\",\"v\":\"2"), 0600)
+
+	store, err := OpenStore(KVStore, path)
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	defer store.Close()
+
+	revisions, _ := store.Load()
+	assertString(t, "1", revisions["portus-head"])
+
+	// The incomplete record has been compacted away.
+	data, _ := ioutil.ReadFile(path)
+	assertString(t, "{\"k\":\"portus-head\",\"v\":\"1\"}\n", string(data))
+}
+
+func TestOpenStoreMemory(t *testing.T) {
+	store, err := OpenStore(KVStore, "")
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if _, ok := store.(*memoryStore); !ok {
+		t.Fatalf("Expecting a memory store")
+	}
+}
+
+func TestOpenStoreUnknownFormat(t *testing.T) {
+	_, err := OpenStore("unknown", "/tmp/whatever")
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "unknown state format 'unknown'", err.Error())
+}
+
+func TestKVStoreDeleteWithoutClosing(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.kv")
+
+	store, _ := OpenStore(KVStore, path)
+	defer store.Close()
+	store.Set("portus-head", "1")
+	store.Delete("portus-head")
+
+	// Simulating a crash: the log is replayed without being compacted first.
+	other, err := OpenStore(KVStore, path)
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	defer other.Close()
+	revisions, _ := other.Load()
+	if _, ok := revisions["portus-head"]; ok {
+		t.Fatalf("Expecting the revision to be deleted")
+	}
+}
+
+func TestReadStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, format := range []string{JSONStore, KVStore} {
+		path := filepath.Join(dir, "state."+format)
+		store, _ := OpenStore(format, path)
+		store.Set("portus-head", "1")
+		store.Close()
+
+		before, _ := os.Stat(path)
+		revisions, err := ReadStore(format, path)
+		if err != nil {
+			t.Fatalf("Expecting no errors, got: %v", err)
+		}
+		assertString(t, "1", revisions["portus-head"])
+
+		after, _ := os.Stat(path)
+		if !before.ModTime().Equal(after.ModTime()) {
+			t.Fatalf("The store should not have been modified")
+		}
+	}
+
+	revisions, err := ReadStore(JSONStore, filepath.Join(dir, "unknown"))
+	if err != nil || len(revisions) != 0 {
+		t.Fatalf("Expecting no revisions and no errors")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "unknown")); !os.IsNotExist(err) {
+		t.Fatalf("The store should not have been created")
+	}
+}
@@ -16,81 +16,467 @@
 package lib
 
 import (
+	"context"
+	"errors"
 	"log"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+// ErrGracePeriodExceeded is returned by Sync when it was stopped while some
+// triggers were still running, and they did not finish within the grace
+// period.
+var ErrGracePeriodExceeded = errors.New("grace period exceeded, some triggers were aborted")
+
+// state holds the last triggered revision of each listener. It is safe to be
+// used concurrently.
 type state struct {
-	done      bool
+	mutex     sync.Mutex
 	revisions map[string]string
+	store     Store
+
+	// seen contains the listeners for which a revision has been fetched
+	// since the program started.
+	seen map[string]bool
+
+	// triggers is the context to be used by triggers. It is only canceled
+	// after the grace period following a shutdown.
+	triggers context.Context
+}
+
+// revision returns the last triggered revision for the given listener.
+func (st *state) revision(name string) (string, bool) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	rev, ok := st.revisions[name]
+	return rev, ok
+}
+
+// forget removes the last triggered revision of the given listener, both from
+// memory and from the store.
+func (st *state) forget(name string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	delete(st.revisions, name)
+	delete(st.seen, name)
+	return st.store.Delete(name)
+}
+
+// first marks the given listener as seen, and returns true if this is the
+// first time it has been seen.
+func (st *state) first(name string) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.seen[name] {
+		return false
+	}
+	st.seen[name] = true
+	return true
+}
+
+// update sets the last triggered revision for the given listener and persists
+// it into the store.
+func (st *state) update(name, rev string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.revisions[name] = rev
+	return st.store.Set(name, rev)
+}
+
+// schedule keeps track of when each listener has to be synchronized next.
+type schedule struct {
+	next map[string]time.Time
+}
+
+// newSchedule returns a schedule in which all the given listeners have just
+// been synchronized at the given time.
+func newSchedule(cfg *Configuration, now time.Time) *schedule {
+	sch := &schedule{next: make(map[string]time.Time)}
+	for _, list := range cfg.Listeners {
+		sch.done(cfg, list, now)
+	}
+	return sch
+}
+
+// wait returns how much time has to pass from the given time until the next
+// listener is due.
+func (sch *schedule) wait(now time.Time) time.Duration {
+	var first time.Time
+	for _, t := range sch.next {
+		if first.IsZero() || t.Before(first) {
+			first = t
+		}
+	}
+	if first.IsZero() || !first.After(now) {
+		return 0
+	}
+	return first.Sub(now)
+}
+
+// timer returns a channel that receives the time when the next listener is
+// due. If there are no listeners, the channel is nil so it blocks forever.
+func (sch *schedule) timer(now time.Time) <-chan time.Time {
+	if len(sch.next) == 0 {
+		return nil
+	}
+	return time.After(sch.wait(now))
+}
+
+// due returns the listeners that have to be synchronized at the given time.
+func (sch *schedule) due(cfg *Configuration, now time.Time) []Listener {
+	res := []Listener{}
+	for _, list := range cfg.Listeners {
+		if !sch.next[list.Name].After(now) {
+			res = append(res, list)
+		}
+	}
+	return res
+}
+
+// now marks the given listener to be synchronized as soon as possible.
+func (sch *schedule) now(list Listener, now time.Time) {
+	sch.next[list.Name] = now
+}
+
+// reschedule applies the current interval of the given listener from the last
+// time it was synchronized, which is computed from the given previous interval.
+// Listeners that are already due are left as they are.
+func (sch *schedule) reschedule(cfg *Configuration, list Listener, previous time.Duration, now time.Time) {
+	next, ok := sch.next[list.Name]
+	if ok && next.After(now) {
+		sch.done(cfg, list, next.Add(-previous))
+	}
+}
+
+// remove removes the given listener from the schedule.
+func (sch *schedule) remove(name string) {
+	delete(sch.next, name)
+}
+
+// done marks the given listener as synchronized at the given time.
+func (sch *schedule) done(cfg *Configuration, list Listener, now time.Time) {
+	sch.next[list.Name] = now.Add(intervalFor(cfg, list))
+}
+
+// intervalFor returns the interval in which the given listener has to be
+// synchronized.
+func intervalFor(cfg *Configuration, list Listener) time.Duration {
+	if list.Interval > 0 {
+		return list.Interval
+	}
+	if cfg.Interval > 0 {
+		return cfg.Interval
+	}
+	return defaultInterval
 }
 
-var syncTimeout = 5 * time.Minute
+// Sync synchronizes all the listeners from the given configuration and, unless
+// only a single shot was requested, keeps doing so following the interval of
+// each listener. It stops when the given context is canceled: listeners that
+// have not started yet are skipped, and triggers that were already started
+// are given `cfg.GracePeriod` to finish. Configurations sent through the given
+// channel replace the current one between executions.
+func Sync(ctx context.Context, cfg *Configuration, reloads <-chan *Configuration) (err error) {
+	store, revisions, err := openState(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := store.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
 
-func Sync(cfg *Configuration) error {
+	triggers, cancel := graceContext(ctx, cfg.GracePeriod)
+	defer cancel()
 	st := &state{
-		done:      false,
-		revisions: make(map[string]string),
+		revisions: revisions,
+		store:     store,
+		seen:      make(map[string]bool),
+		triggers:  triggers,
 	}
 
-	performSync(cfg, st)
+	performSync(ctx, cfg, st, cfg.Listeners)
+	if ctx.Err() != nil {
+		return stopped(st)
+	}
 	if cfg.SingleShot {
 		log.Printf("Only one execution was needed, stopping...")
 		return nil
 	}
 
 	log.Printf("Listening...")
+	sch := newSchedule(cfg, time.Now())
 	for {
 		select {
-		case <-time.After(syncTimeout):
-			if !st.done {
-				log.Printf("Previous execution is not done, waiting...")
-			} else {
-				st.done = false
-				performSync(cfg, st)
+		case <-ctx.Done():
+			return stopped(st)
+		case next := <-reloads:
+			cfg = reload(cfg, next, st, sch, time.Now())
+			continue
+		case <-sch.timer(time.Now()):
+		}
+
+		now := time.Now()
+		due := sch.due(cfg, now)
+		performSync(ctx, cfg, st, due)
+		if ctx.Err() != nil {
+			return stopped(st)
+		}
+		for _, list := range due {
+			sch.done(cfg, list, now)
+		}
+	}
+}
+
+// reload returns the new configuration to be used after updating the given
+// state and schedule. The revisions of listeners that were removed or whose
+// identity changed are forgotten, and new listeners are scheduled right away.
+// The new interval of the remaining ones applies from their last run. Idle
+// connections of the old configuration are closed.
+func reload(old, cfg *Configuration, st *state, sch *schedule, now time.Time) *Configuration {
+	diff := diffListeners(old.Listeners, cfg.Listeners)
+	previous := make(map[string]Listener)
+	for _, list := range old.Listeners {
+		previous[list.Name] = list
+	}
+
+	for _, name := range diff.removed {
+		log.Printf("%v: service removed", name)
+		sch.remove(name)
+		if err := st.forget(name); err != nil {
+			log.Printf("%v: could not forget revision: %v", name, err)
+		}
+	}
+	for _, list := range cfg.Listeners {
+		if diff.added[list.Name] {
+			log.Printf("%v: service added", list.Name)
+			sch.now(list, now)
+			continue
+		}
+		if diff.changed[list.Name] {
+			log.Printf("%v: service changed", list.Name)
+			if diff.moved[list.Name] {
+				if err := st.forget(list.Name); err != nil {
+					log.Printf("%v: could not forget revision: %v", list.Name, err)
+				}
+				sch.now(list, now)
+				continue
 			}
 		}
+
+		// The interval might have changed, either for this listener or
+		// globally.
+		sch.reschedule(cfg, list, intervalFor(old, previous[list.Name]), now)
+	}
+
+	// The new configuration comes with its own clients, so the connections
+	// kept by the old ones are not needed anymore.
+	if old != cfg {
+		old.closeIdleConnections()
+	}
+
+	log.Printf("Configuration reloaded: %v added, %v removed, %v changed",
+		len(diff.added), len(diff.removed), len(diff.changed))
+	return cfg
+}
+
+// openState returns the store to be used and the revisions persisted in it. On
+// dry runs the persisted revisions are taken into account, but the store is
+// never modified.
+func openState(cfg *Configuration) (Store, map[string]string, error) {
+	if cfg.DryRun {
+		revisions, err := ReadStore(cfg.StateFormat, cfg.StatePath)
+		return &memoryStore{}, revisions, err
+	}
+
+	store, err := OpenStore(cfg.StateFormat, cfg.StatePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	revisions, err := store.Load()
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+	return store, revisions, nil
+}
+
+// graceContext returns a context that is canceled once the given grace period
+// has passed since the given parent context was canceled.
+func graceContext(parent context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-parent.Done():
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-time.After(grace):
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// stopped returns the error to be returned by Sync after being stopped.
+func stopped(st *state) error {
+	if st.triggers.Err() != nil {
+		return ErrGracePeriodExceeded
 	}
+	log.Printf("Stopped")
 	return nil
 }
 
-func performSync(cfg *Configuration, st *state) {
+// workersFor returns the number of workers to be used when synchronizing the
+// given amount of listeners.
+func workersFor(cfg *Configuration, listeners int) int {
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if listeners < workers {
+		return listeners
+	}
+	return workers
+}
+
+// performSync synchronizes the given listeners through a pool of workers, so
+// there are never more than `cfg.Workers` listeners in-flight. It returns when
+// all of them have been synchronized, or when the context has been canceled
+// and the in-flight listeners are done.
+func performSync(ctx context.Context, cfg *Configuration, st *state, listeners []Listener) {
 	var waitGroup sync.WaitGroup
-	waitGroup.Add(len(cfg.Listeners))
-	defer func() {
-		waitGroup.Wait()
-		st.done = true
-	}()
+	jobs := make(chan Listener)
 
-	for _, v := range cfg.Listeners {
-		go func(list Listener) {
+	workers := workersFor(cfg, len(listeners))
+	waitGroup.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
 			defer waitGroup.Done()
-			synchronize(cfg, list, st)
-		}(v)
+			for list := range jobs {
+				synchronize(ctx, cfg, list, st)
+			}
+		}()
+	}
+
+loop:
+	for _, list := range listeners {
+		select {
+		case jobs <- list:
+		case <-ctx.Done():
+			break loop
+		}
 	}
+	close(jobs)
+	waitGroup.Wait()
 }
 
-func synchronize(cfg *Configuration, list Listener, st *state) {
-	if !statusSucceeded(cfg, list) {
+func synchronize(ctx context.Context, cfg *Configuration, list Listener, st *state) {
+	if ctx.Err() != nil {
 		return
 	}
-	rev := fetchRevision(cfg, list)
-	if rev == "" {
+	if !statusSucceeded(ctx, cfg, list) {
+		if cfg.DryRun {
+			log.Printf("[dry-run] %v: the package has not been built successfully, nothing would be triggered", list.Name)
+		}
+		return
+	}
+	info := fetchBuildInfo(ctx, cfg, list)
+	if info == nil || info.Revision == "" {
+		if cfg.DryRun {
+			log.Printf("[dry-run] %v: could not fetch the revision, nothing would be triggered", list.Name)
+		}
+		return
+	}
+	rev := info.Revision
+
+	val, ok := st.revision(list.Name)
+	first := st.first(list.Name)
+	if ok && val == rev {
+		log.Printf("%v: everything up-to-date, skipping...", list.Name)
+		return
+	}
+	if first && !triggerInitial(list, val, ok, rev) {
+		log.Printf("%v: recording revision '%v' as the baseline, nothing triggered", list.Name, rev)
+		if err := st.update(list.Name, rev); err != nil {
+			log.Printf("%v: could not persist revision '%v': %v", list.Name, rev, err)
+		}
+		return
+	}
+
+	// Wait until OBS has published the package so images do not get built
+	// with the old one. The check will be performed again on the next run.
+	if list.waitsForPublish() && !repositoryPublished(ctx, cfg, list) {
+		return
+	}
+	if list.VerifyRepoURL != "" && !packageInRepository(ctx, cfg, list, info) {
 		return
 	}
 
-	val, ok := st.revisions[list.Name]
-	if !ok || val != rev {
-		if updateHub(cfg.Token, list.Repository, list.Tags) {
-			log.Printf("Updated to revision '%v' the tags: %v; for repository '%v'",
-				rev, joinTags(list.Tags), list.Repository)
-			st.revisions[list.Name] = rev
+	// Do not start new triggers when shutting down.
+	if ctx.Err() != nil {
+		return
+	}
+
+	trigger, err := triggerFor(cfg, list)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return
+	}
+	ev := newEvent(list, rev)
+
+	if cfg.DryRun {
+		log.Printf("[dry-run] %v: would update from revision '%v' to '%v' the tags: %v; for %v",
+			list.Name, val, rev, joinTags(list.Tags), trigger)
+		for _, action := range trigger.Describe(ev) {
+			log.Printf("[dry-run] %v: %v", list.Name, action)
 		}
+	} else if err := trigger.Fire(st.triggers, ev); err == nil {
+		log.Printf("Updated to revision '%v' the tags: %v; for %v",
+			rev, joinTags(list.Tags), trigger)
 	} else {
-		log.Printf("%v: everything up-to-date, skipping...", list.Name)
+		log.Printf("%v: %v", list.Name, err)
+		return
+	}
+
+	if err := st.update(list.Name, rev); err != nil {
+		log.Printf("%v: could not persist revision '%v': %v", list.Name, rev, err)
+	}
+}
+
+// triggerInitial returns true if the tags of the given listener have to be
+// triggered when the given revision is the first one seen for it. The
+// persisted revision is given by `val` and `ok`.
+func triggerInitial(list Listener, val string, ok bool, rev string) bool {
+	switch list.Initial {
+	case InitialRecordOnly:
+		return ok
+	case InitialTriggerIfNewer:
+		return ok && newerRevision(rev, val)
+	}
+	return true
+}
+
+// newerRevision returns true if the given revision is newer than the previous
+// one. Revisions are compared numerically if possible, otherwise any
+// different revision is considered newer.
+func newerRevision(rev, previous string) bool {
+	a, errA := strconv.Atoi(rev)
+	b, errB := strconv.Atoi(previous)
+	if errA == nil && errB == nil {
+		return a > b
 	}
+	return rev != previous
 }
 
 func joinTags(tags []string) string {
@@ -17,10 +17,18 @@ package lib
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func assertString(t *testing.T, exp, got string) {
@@ -63,7 +71,7 @@ func TestSyncSingleShotOK(t *testing.T) {
 	dockerHub = hub.URL + "/"
 
 	// Call Sync.
-	res := Sync(&Configuration{
+	res := Sync(context.Background(), &Configuration{
 		Server:     obs.URL,
 		User:       "user",
 		Password:   "password",
@@ -80,12 +88,12 @@ func TestSyncSingleShotOK(t *testing.T) {
 				Tags:         []string{"2.3", "latest"},
 			},
 		},
-	})
+	}, nil)
 
 	if res != nil {
 		t.Fatalf("An error occurred: %#v\n", res.Error())
 	}
-	if opts.tagsPushed != "-2.3-latest" {
+	if opts.pushed() != "-2.3-latest" {
 		t.Fatalf("Not all tags were pushed")
 	}
 	logged := buf.String()
@@ -117,7 +125,7 @@ func TestSyncOBSFails(t *testing.T) {
 	dockerHub = hub.URL + "/"
 
 	// Call Sync.
-	res := Sync(&Configuration{
+	res := Sync(context.Background(), &Configuration{
 		Server:     obs.URL,
 		User:       "user",
 		Password:   "password",
@@ -134,12 +142,12 @@ func TestSyncOBSFails(t *testing.T) {
 				Tags:         []string{"2.3", "latest"},
 			},
 		},
-	})
+	}, nil)
 
 	if res != nil {
 		t.Fatalf("An error occurred: %#v\n", res.Error())
 	}
-	if opts.tagsPushed != "" {
+	if opts.pushed() != "" {
 		t.Fatalf("Some tags were pushed")
 	}
 }
@@ -166,7 +174,7 @@ func TestSyncHubFails(t *testing.T) {
 	dockerHub = hub.URL + "/"
 
 	// Call Sync.
-	res := Sync(&Configuration{
+	res := Sync(context.Background(), &Configuration{
 		Server:     obs.URL,
 		User:       "user",
 		Password:   "password",
@@ -183,12 +191,783 @@ func TestSyncHubFails(t *testing.T) {
 				Tags:         []string{"2.3", "latest"},
 			},
 		},
-	})
+	}, nil)
 
 	if res != nil {
 		t.Fatalf("An error occurred: %#v\n", res.Error())
 	}
-	if opts.tagsPushed != "" {
+	if opts.pushed() != "" {
 		t.Fatalf("Some tags were pushed")
 	}
 }
+
+func TestSyncPersistsState(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Setting up servers.
+	obs := testOBS(&testOptions{
+		fail:        false,
+		timeout:     false,
+		decodeError: false,
+	})
+	defer obs.Close()
+
+	opts := &testOptions{
+		fail:    false,
+		timeout: false,
+	}
+	hub := testHub(opts)
+	defer hub.Close()
+	dockerHub = hub.URL + "/"
+
+	cfg := &Configuration{
+		Server:      obs.URL,
+		User:        "user",
+		Password:    "password",
+		Token:       "token",
+		SingleShot:  true,
+		StatePath:   filepath.Join(dir, "state.json"),
+		StateFormat: JSONStore,
+		Listeners: []Listener{
+			{
+				Name:         "portus-2.3",
+				Project:      "Virtualization:containers:Portus:2.3",
+				Distribution: "openSUSE_Leap_42.3",
+				Architecture: "x86_64",
+				Package:      "portus",
+				Repository:   "opensuse/portus",
+				Tags:         []string{"2.3", "latest"},
+			},
+		},
+	}
+
+	// The first run triggers the tags, the second one (e.g. after a restart)
+	// picks up the persisted revision and skips them.
+	if res := Sync(context.Background(), cfg, nil); res != nil {
+		t.Fatalf("An error occurred: %#v\n", res.Error())
+	}
+	if res := Sync(context.Background(), cfg, nil); res != nil {
+		t.Fatalf("An error occurred: %#v\n", res.Error())
+	}
+
+	if opts.pushed() != "-2.3-latest" {
+		t.Fatalf("Tags were pushed more than once: %v", opts.pushed())
+	}
+	if !strings.Contains(buf.String(), "portus-2.3: everything up-to-date, skipping...") {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	cfg := &Configuration{
+		Interval: time.Hour,
+		Listeners: []Listener{
+			{Name: "head", Interval: time.Minute},
+			{Name: "stable"},
+		},
+	}
+	now := time.Now()
+	sch := newSchedule(cfg, now)
+
+	if wait := sch.wait(now); wait != time.Minute {
+		t.Fatalf("Expecting to wait 1m, got %v", wait)
+	}
+	if due := sch.due(cfg, now); len(due) != 0 {
+		t.Fatalf("Expecting no listeners to be due, got %v", len(due))
+	}
+
+	// After one minute only the head listener is due.
+	now = now.Add(time.Minute)
+	due := sch.due(cfg, now)
+	if len(due) != 1 {
+		t.Fatalf("Expecting one listener to be due, got %v", len(due))
+	}
+	assertString(t, "head", due[0].Name)
+	sch.done(cfg, due[0], now)
+
+	// One hour after the start both are due.
+	now = now.Add(59 * time.Minute)
+	if wait := sch.wait(now); wait != 0 {
+		t.Fatalf("Expecting not to wait, got %v", wait)
+	}
+	if due := sch.due(cfg, now); len(due) != 2 {
+		t.Fatalf("Expecting two listeners to be due, got %v", len(due))
+	}
+}
+
+func TestScheduleEmpty(t *testing.T) {
+	now := time.Now()
+	sch := newSchedule(&Configuration{}, now)
+	if sch.timer(now) != nil {
+		t.Fatalf("Expecting no timer without listeners")
+	}
+
+	sch.now(Listener{Name: "head"}, now)
+	if sch.timer(now) == nil {
+		t.Fatalf("Expecting a timer")
+	}
+	sch.remove("head")
+	if sch.timer(now) != nil {
+		t.Fatalf("Expecting no timer after removing the last listener")
+	}
+}
+
+func TestSyncNoListeners(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+	opts := &testOptions{}
+	hub, started := slowHub(opts, 0)
+	defer hub.Close()
+	dockerHub = hub.URL + "/"
+
+	cfg := testShutdownConfiguration(obs.URL, time.Second)
+	cfg.Listeners = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	reloads := make(chan *Configuration)
+	res := make(chan error)
+	go func() { res <- Sync(ctx, cfg, reloads) }()
+
+	// Sync waits for reloads without any listener, and the ones added are
+	// synchronized right away.
+	reloads <- testShutdownConfiguration(obs.URL, time.Second)
+	<-started
+	<-started
+
+	// Removing all of them again leaves it waiting until it is canceled.
+	reloads <- cfg
+	cancel()
+	if err := <-res; err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if opts.pushed() != "-2.3-latest" {
+		t.Fatalf("Unexpected pushed tags: %v", opts.pushed())
+	}
+	if !strings.Contains(buf.String(), "Configuration reloaded: 0 added, 1 removed, 0 changed") {
+		t.Fatalf("Wrong log: %v", buf.String())
+	}
+}
+
+func TestIntervalFor(t *testing.T) {
+	cfg := &Configuration{}
+	if d := intervalFor(cfg, Listener{}); d != defaultInterval {
+		t.Fatalf("Expecting the default interval, got %v", d)
+	}
+	cfg.Interval = time.Hour
+	if d := intervalFor(cfg, Listener{}); d != time.Hour {
+		t.Fatalf("Expecting 1h, got %v", d)
+	}
+	if d := intervalFor(cfg, Listener{Interval: time.Minute}); d != time.Minute {
+		t.Fatalf("Expecting 1m, got %v", d)
+	}
+}
+
+func TestSyncWorkerPool(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	// OBS server that keeps track of how many listeners are in-flight.
+	var mutex sync.Mutex
+	inflight, peak := 0, 0
+	obs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		inflight++
+		if inflight > peak {
+			peak = inflight
+		}
+		mutex.Unlock()
+		defer func() {
+			mutex.Lock()
+			inflight--
+			mutex.Unlock()
+		}()
+
+		time.Sleep(5 * time.Millisecond)
+		if strings.HasSuffix(r.URL.String(), "/_status") {
+			fmt.Fprint(w, "<status package=\"portus\" code=\"succeeded\" />")
+		} else {
+			fmt.Fprint(w, "<buildinfo><rev>1234</rev></buildinfo>")
+		}
+	}))
+	defer obs.Close()
+
+	opts := &testOptions{}
+	hub := testHub(opts)
+	defer hub.Close()
+	dockerHub = hub.URL + "/"
+
+	cfg := &Configuration{
+		Server:     obs.URL,
+		User:       "user",
+		Password:   "password",
+		Token:      "token",
+		SingleShot: true,
+		Workers:    4,
+	}
+	for i := 0; i < 40; i++ {
+		cfg.Listeners = append(cfg.Listeners, Listener{
+			Name:         fmt.Sprintf("portus-%v", i),
+			Project:      "Virtualization:containers:Portus",
+			Distribution: "openSUSE_Leap_15.0",
+			Architecture: "x86_64",
+			Package:      "portus",
+			Repository:   "opensuse/portus",
+			Tags:         []string{fmt.Sprintf("tag%v", i)},
+		})
+	}
+
+	if res := Sync(context.Background(), cfg, nil); res != nil {
+		t.Fatalf("An error occurred: %#v\n", res.Error())
+	}
+
+	if n := strings.Count(opts.pushed(), "-tag"); n != 40 {
+		t.Fatalf("Expecting 40 tags to be pushed, got %v", n)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if peak > 4 {
+		t.Fatalf("Expecting at most 4 listeners in-flight, got %v", peak)
+	}
+}
+
+func TestStateConcurrentAccess(t *testing.T) {
+	st := &state{revisions: make(map[string]string), store: &memoryStore{}}
+
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			name := fmt.Sprintf("listener-%v", i%5)
+			st.update(name, fmt.Sprintf("%v", i))
+			st.revision(name)
+		}(i)
+	}
+	waitGroup.Wait()
+
+	for i := 0; i < 5; i++ {
+		if _, ok := st.revision(fmt.Sprintf("listener-%v", i)); !ok {
+			t.Fatalf("Expecting listener-%v to have a revision", i)
+		}
+	}
+}
+
+func TestWorkersFor(t *testing.T) {
+	if n := workersFor(&Configuration{}, 100); n != defaultWorkers {
+		t.Fatalf("Expecting the default number of workers, got %v", n)
+	}
+	if n := workersFor(&Configuration{Workers: 4}, 100); n != 4 {
+		t.Fatalf("Expecting 4 workers, got %v", n)
+	}
+	if n := workersFor(&Configuration{Workers: 4}, 2); n != 2 {
+		t.Fatalf("Expecting 2 workers, got %v", n)
+	}
+}
+
+func testShutdownConfiguration(obs string, grace time.Duration) *Configuration {
+	return &Configuration{
+		Server:      obs,
+		User:        "user",
+		Password:    "password",
+		Token:       "token",
+		Interval:    time.Hour,
+		GracePeriod: grace,
+		Listeners: []Listener{
+			{
+				Name:         "portus-2.3",
+				Project:      "Virtualization:containers:Portus:2.3",
+				Distribution: "openSUSE_Leap_42.3",
+				Architecture: "x86_64",
+				Package:      "portus",
+				Repository:   "opensuse/portus",
+				Tags:         []string{"2.3", "latest"},
+			},
+		},
+	}
+}
+
+// slowHub returns a Docker Hub server that takes the given delay on each
+// request. The returned channel gets a value each time a request starts.
+func slowHub(opts *testOptions, delay time.Duration) (*httptest.Server, chan struct{}) {
+	started := make(chan struct{}, 16)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		time.Sleep(delay)
+
+		str := getFromBody(r)
+		opts.mutex.Lock()
+		opts.tagsPushed = opts.tagsPushed + "-" + str
+		opts.mutex.Unlock()
+	})), started
+}
+
+func TestSyncStopsWhenCanceled(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+	opts := &testOptions{}
+	hub, started := slowHub(opts, 0)
+	defer hub.Close()
+	dockerHub = hub.URL + "/"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res := make(chan error)
+	go func() { res <- Sync(ctx, testShutdownConfiguration(obs.URL, time.Second), nil) }()
+
+	<-started
+	<-started
+	cancel()
+
+	select {
+	case err := <-res:
+		if err != nil {
+			t.Fatalf("Expecting no errors, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Sync did not stop")
+	}
+	if opts.pushed() != "-2.3-latest" {
+		t.Fatalf("Not all tags were pushed")
+	}
+}
+
+func TestSyncGracePeriod(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+	opts := &testOptions{}
+	hub, started := slowHub(opts, 100*time.Millisecond)
+	defer hub.Close()
+	dockerHub = hub.URL + "/"
+
+	// Shutting down as soon as the first tag is being triggered: the whole set
+	// of tags has to be triggered anyways.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	cfg := testShutdownConfiguration(obs.URL, 5*time.Second)
+	cfg.StatePath = filepath.Join(dir, "state.json")
+	if err := Sync(ctx, cfg, nil); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if opts.pushed() != "-2.3-latest" {
+		t.Fatalf("Not all tags were pushed")
+	}
+
+	store, _ := OpenStore(JSONStore, cfg.StatePath)
+	defer store.Close()
+	revisions, _ := store.Load()
+	assertString(t, "1234", revisions["portus-2.3"])
+}
+
+func TestSyncGracePeriodExceeded(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+	opts := &testOptions{}
+	hub, started := slowHub(opts, time.Second)
+	defer hub.Close()
+	dockerHub = hub.URL + "/"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	cfg := testShutdownConfiguration(obs.URL, 10*time.Millisecond)
+	cfg.StatePath = filepath.Join(dir, "state.json")
+	if err := Sync(ctx, cfg, nil); err != ErrGracePeriodExceeded {
+		t.Fatalf("Expecting the grace period to be exceeded, got: %v", err)
+	}
+
+	store, _ := OpenStore(JSONStore, cfg.StatePath)
+	defer store.Close()
+	revisions, _ := store.Load()
+	if _, ok := revisions["portus-2.3"]; ok {
+		t.Fatalf("The revision should not have been persisted")
+	}
+}
+
+func TestSyncCanceledBeforeStarting(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	obsOpts := &testOptions{}
+	obs := testOBS(obsOpts)
+	defer obs.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cfg := testShutdownConfiguration(obs.URL, time.Second)
+	if err := Sync(ctx, cfg, nil); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	obsOpts.mutex.Lock()
+	defer obsOpts.mutex.Unlock()
+	if obsOpts.n != 0 {
+		t.Fatalf("Expecting no requests to OBS, got %v", obsOpts.n)
+	}
+}
+
+func TestSyncReload(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+	opts := &testOptions{}
+	hub, started := slowHub(opts, 0)
+	defer hub.Close()
+	dockerHub = hub.URL + "/"
+
+	cfg := testShutdownConfiguration(obs.URL, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	reloads := make(chan *Configuration)
+	res := make(chan error)
+	go func() { res <- Sync(ctx, cfg, reloads) }()
+
+	// Wait for the initial execution.
+	<-started
+	<-started
+
+	// Tags from the existing listener change, but it still follows the same
+	// package. Moreover, a new listener is added.
+	next := testShutdownConfiguration(obs.URL, time.Second)
+	next.Listeners[0].Tags = []string{"2.3"}
+	next.Listeners = append(next.Listeners, Listener{
+		Name:         "portus-head",
+		Project:      "Virtualization:containers:Portus",
+		Distribution: "openSUSE_Leap_15.0",
+		Architecture: "x86_64",
+		Package:      "portus",
+		Repository:   "opensuse/portus",
+		Tags:         []string{"head"},
+	})
+	reloads <- next
+
+	// Only the new listener gets triggered.
+	<-started
+	cancel()
+	if err := <-res; err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if opts.pushed() != "-2.3-latest-head" {
+		t.Fatalf("Unexpected pushed tags: %v", opts.pushed())
+	}
+
+	logged := buf.String()
+	for _, msg := range []string{
+		"portus-head: service added",
+		"portus-2.3: service changed",
+		"Configuration reloaded: 1 added, 0 removed, 1 changed",
+	} {
+		if !strings.Contains(logged, msg) {
+			t.Fatalf("Wrong log: '%v' not found", msg)
+		}
+	}
+
+	// Lowering the interval of a listener applies from its last run, instead
+	// of waiting for the old interval to pass.
+	start := time.Now()
+	cfg.Listeners[0].Interval = time.Hour
+	sch := newSchedule(cfg, start)
+	st := &state{revisions: make(map[string]string), seen: make(map[string]bool), store: &memoryStore{}}
+	next = testShutdownConfiguration(obs.URL, time.Second)
+	next.Listeners[0].Interval = time.Minute
+	reload(cfg, next, st, sch, start.Add(time.Second))
+	if !sch.next["portus-2.3"].Equal(start.Add(time.Minute)) {
+		t.Fatalf("Expecting to be rescheduled in a minute, got: %v", sch.next["portus-2.3"].Sub(start))
+	}
+
+	// Listeners that were due already stay that way.
+	reload(next, cfg, st, sch, start.Add(2*time.Minute))
+	if sch.next["portus-2.3"].After(start.Add(2 * time.Minute)) {
+		t.Fatalf("Expecting to stay due, got: %v", sch.next["portus-2.3"].Sub(start))
+	}
+}
+
+func TestSyncDryRun(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	ioutil.WriteFile(path, []byte(`{"portus-head": "1234"}`), 0600)
+
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+	opts := &testOptions{}
+	hub := testHub(opts)
+	defer hub.Close()
+	dockerHub = hub.URL + "/"
+
+	cfg := testShutdownConfiguration(obs.URL, time.Second)
+	cfg.SingleShot = true
+	cfg.DryRun = true
+	cfg.StatePath = path
+	cfg.Token = "secrettoken"
+	cfg.Listeners = append(cfg.Listeners, Listener{
+		Name:         "portus-head",
+		Project:      "Virtualization:containers:Portus",
+		Distribution: "openSUSE_Leap_15.0",
+		Architecture: "x86_64",
+		Package:      "portus",
+		Repository:   "opensuse/portus",
+		Tags:         []string{"head"},
+	})
+
+	if err := Sync(context.Background(), cfg, nil); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if opts.pushed() != "" {
+		t.Fatalf("Nothing should've been pushed")
+	}
+
+	logged := buf.String()
+	for _, msg := range []string{
+		"portus-head: everything up-to-date, skipping...",
+		"[dry-run] portus-2.3: would update from revision '' to '1234' the tags: '2.3', 'latest'; for repository 'opensuse/portus'",
+		"[dry-run] portus-2.3: POST " + hub.URL + "/opensuse/portus/trigger/***/ Content-Type: application/json {\"docker_tag\": \"2.3\"}",
+		"[dry-run] portus-2.3: POST " + hub.URL + "/opensuse/portus/trigger/***/ Content-Type: application/json {\"docker_tag\": \"latest\"}",
+	} {
+		if !strings.Contains(logged, msg) {
+			t.Fatalf("Wrong log: '%v' not found in:\n%v", msg, logged)
+		}
+	}
+	if strings.Contains(logged, "secrettoken") {
+		t.Fatalf("The token should not be logged")
+	}
+
+	// The state file has not been touched.
+	data, _ := ioutil.ReadFile(path)
+	assertString(t, `{"portus-head": "1234"}`, string(data))
+}
+
+func TestSyncDryRunFailedBuild(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	obs := testOBS(&testOptions{fail: true})
+	defer obs.Close()
+
+	cfg := testShutdownConfiguration(obs.URL, time.Second)
+	cfg.SingleShot = true
+	cfg.DryRun = true
+
+	if err := Sync(context.Background(), cfg, nil); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	msg := "[dry-run] portus-2.3: the package has not been built successfully, nothing would be triggered"
+	if !strings.Contains(buf.String(), msg) {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func testInitialPolicy(t *testing.T, initial, persisted string) (string, map[string]string) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	if persisted != "" {
+		ioutil.WriteFile(path, []byte(`{"portus-2.3": "`+persisted+`"}`), 0600)
+	}
+
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+	opts := &testOptions{}
+	hub := testHub(opts)
+	defer hub.Close()
+	dockerHub = hub.URL + "/"
+
+	cfg := testShutdownConfiguration(obs.URL, time.Second)
+	cfg.SingleShot = true
+	cfg.StatePath = path
+	cfg.Listeners[0].Initial = initial
+
+	if err := Sync(context.Background(), cfg, nil); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	revisions, _ := ReadStore(JSONStore, path)
+	return opts.pushed(), revisions
+}
+
+func TestSyncInitialTrigger(t *testing.T) {
+	pushed, revisions := testInitialPolicy(t, InitialTrigger, "")
+	assertString(t, "-2.3-latest", pushed)
+	assertString(t, "1234", revisions["portus-2.3"])
+}
+
+func TestSyncInitialRecordOnly(t *testing.T) {
+	pushed, revisions := testInitialPolicy(t, InitialRecordOnly, "")
+	assertString(t, "", pushed)
+	assertString(t, "1234", revisions["portus-2.3"])
+
+	// A persisted revision is not a fresh deployment: trigger as usual.
+	pushed, revisions = testInitialPolicy(t, InitialRecordOnly, "1000")
+	assertString(t, "-2.3-latest", pushed)
+	assertString(t, "1234", revisions["portus-2.3"])
+
+	pushed, revisions = testInitialPolicy(t, InitialRecordOnly, "1234")
+	assertString(t, "", pushed)
+	assertString(t, "1234", revisions["portus-2.3"])
+}
+
+func TestSyncInitialTriggerIfNewer(t *testing.T) {
+	// No state: record it as the baseline.
+	pushed, revisions := testInitialPolicy(t, InitialTriggerIfNewer, "")
+	assertString(t, "", pushed)
+	assertString(t, "1234", revisions["portus-2.3"])
+
+	// Older state: trigger.
+	pushed, revisions = testInitialPolicy(t, InitialTriggerIfNewer, "1000")
+	assertString(t, "-2.3-latest", pushed)
+	assertString(t, "1234", revisions["portus-2.3"])
+
+	// Newer state: record it as the baseline.
+	pushed, revisions = testInitialPolicy(t, InitialTriggerIfNewer, "2000")
+	assertString(t, "", pushed)
+	assertString(t, "1234", revisions["portus-2.3"])
+}
+
+func TestSyncInitialOnlyOnFirstRevision(t *testing.T) {
+	st := &state{revisions: make(map[string]string), seen: make(map[string]bool), store: &memoryStore{}}
+
+	if !st.first("portus-head") {
+		t.Fatalf("Expecting to be the first time")
+	}
+	if st.first("portus-head") {
+		t.Fatalf("Expecting NOT to be the first time")
+	}
+	st.forget("portus-head")
+	if !st.first("portus-head") {
+		t.Fatalf("Expecting to be the first time after being forgotten")
+	}
+}
+
+func TestNewerRevision(t *testing.T) {
+	for _, c := range []struct {
+		rev, previous string
+		newer         bool
+	}{
+		{"10", "9", true},
+		{"9", "10", false},
+		{"10", "10", false},
+		{"abc", "def", true},
+		{"abc", "abc", false},
+	} {
+		if newerRevision(c.rev, c.previous) != c.newer {
+			t.Fatalf("Unexpected result for '%v' and '%v'", c.rev, c.previous)
+		}
+	}
+}
+
+func TestSyncWaitPublished(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	obsOpts := &testOptions{state: "publishing"}
+	obs := testOBS(obsOpts)
+	defer obs.Close()
+	opts := &testOptions{}
+	hub, started := slowHub(opts, 0)
+	defer hub.Close()
+	dockerHub = hub.URL + "/"
+
+	wait := true
+	cfg := testShutdownConfiguration(obs.URL, time.Second)
+	cfg.Listeners[0].WaitPublished = &wait
+	cfg.Listeners[0].Interval = 20 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res := make(chan error)
+	go func() { res <- Sync(ctx, cfg, nil) }()
+
+	// Let some executions go through while the repository is still being
+	// published, and then publish it.
+	time.Sleep(100 * time.Millisecond)
+	if opts.pushed() != "" {
+		t.Fatalf("Nothing should've been pushed")
+	}
+	obsOpts.mutex.Lock()
+	obsOpts.state = "published"
+	obsOpts.mutex.Unlock()
+
+	<-started
+	<-started
+	cancel()
+	if err := <-res; err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, "-2.3-latest", opts.pushed())
+}
+
+func TestSyncVerifyRepository(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+	repo := testRepository()
+	defer repo.Close()
+	opts := &testOptions{}
+	hub := testHub(opts)
+	defer hub.Close()
+	dockerHub = hub.URL + "/"
+
+	cfg := testShutdownConfiguration(obs.URL, time.Second)
+	cfg.SingleShot = true
+
+	// The package is not in the repository yet.
+	cfg.Listeners[0].VerifyRepoURL = repo.URL + "/unknown"
+	if err := Sync(context.Background(), cfg, nil); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, "", opts.pushed())
+
+	// The package is in the repository.
+	cfg.Listeners[0].VerifyRepoURL = repo.URL
+	if err := Sync(context.Background(), cfg, nil); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertString(t, "-2.3-latest", opts.pushed())
+}
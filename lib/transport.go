@@ -0,0 +1,269 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ProxyDirect disables the proxy for a server, even if one is set in the
+// environment.
+const ProxyDirect = "direct"
+
+// TLSConfig contains the TLS settings for the connections to a server.
+type TLSConfig struct {
+	// CA is the path to a PEM bundle with the certificate authorities to be
+	// trusted on top of the ones from the system.
+	CA string `yaml:"ca"`
+
+	// Cert and Key are the paths to the PEM client certificate and its key.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+
+	// MinVersion is the minimum TLS version: "1.0", "1.1", "1.2" or "1.3".
+	MinVersion string `yaml:"min_version"`
+
+	// InsecureSkipVerify disables the verification of the certificate of the
+	// server. It should only be used for testing.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+// TriggersConfig contains the TLS and proxy settings for the requests that
+// are not performed against an OBS server: triggers and the verification of
+// repositories.
+type TriggersConfig struct {
+	TLS   TLSConfig `yaml:"tls"`
+	Proxy string    `yaml:"proxy"`
+}
+
+// tlsVersions maps the supported values of `min_version` to their constant.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// config returns the crypto/tls configuration described by this one.
+func (cfg TLSConfig) config() (*tls.Config, error) {
+	res := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+
+	if cfg.MinVersion != "" {
+		version, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version '%v'", cfg.MinVersion)
+		}
+		res.MinVersion = version
+	}
+
+	if cfg.CA != "" {
+		pem, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in '%v'", cfg.CA)
+		}
+		res.RootCAs = pool
+	}
+
+	if (cfg.Cert == "") != (cfg.Key == "") {
+		return nil, fmt.Errorf("both the client certificate and its key have to be given")
+	} else if cfg.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, err
+		}
+		res.Certificates = []tls.Certificate{cert}
+	}
+	return res, nil
+}
+
+// proxyFunc returns the proxy function for the given proxy setting. If no
+// proxy is given, the one from the environment is used.
+func proxyFunc(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	switch proxy {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case ProxyDirect:
+		return nil, nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("bad proxy '%v': %v", proxy, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("bad proxy '%v': unsupported scheme '%v'", proxy, u.Scheme)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// HTTPConfig configures the pool of idle connections kept for each endpoint.
+// Zero values pick the defaults.
+type HTTPConfig struct {
+	MaxIdleConns        int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+}
+
+const (
+	// defaultMaxIdleConns is the default maximum of idle connections kept by
+	// a transport.
+	defaultMaxIdleConns = 100
+
+	// defaultMaxIdleConnsPerHost is the default maximum of idle connections
+	// kept by a transport for each host. It is higher than the one from the
+	// standard library so concurrent workers can reuse connections.
+	defaultMaxIdleConnsPerHost = 10
+
+	// defaultIdleConnTimeout is the default time after which idle
+	// connections are closed.
+	defaultIdleConnTimeout = 90 * time.Second
+
+	// maxDrain is the maximum of bytes read from a response body before
+	// closing it. Bodies have to be consumed for connections to be reused,
+	// but huge ones are not worth it.
+	maxDrain = 64 << 10
+)
+
+// validate returns an error if the given pool settings are not valid.
+func (h HTTPConfig) validate() error {
+	if h.MaxIdleConns < 0 || h.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("the maximum of idle connections cannot be negative")
+	}
+	if h.IdleConnTimeout < 0 {
+		return fmt.Errorf("the idle connection timeout cannot be negative")
+	}
+	return nil
+}
+
+// pooledTransport returns a transport with keep-alive connections pooled as
+// given. It uses the proxy from the environment.
+func pooledTransport(pool HTTPConfig) *http.Transport {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          defaultMaxIdleConns,
+		MaxIdleConnsPerHost:   defaultMaxIdleConnsPerHost,
+		IdleConnTimeout:       defaultIdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if pool.MaxIdleConns > 0 {
+		transport.MaxIdleConns = pool.MaxIdleConns
+	}
+	if pool.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = pool.MaxIdleConnsPerHost
+	}
+	if pool.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = pool.IdleConnTimeout
+	}
+	return transport
+}
+
+// newTransport returns a pooled transport with the given TLS and proxy
+// settings.
+func newTransport(tlsCfg TLSConfig, proxy string, pool HTTPConfig) (*http.Transport, error) {
+	config, err := tlsCfg.config()
+	if err != nil {
+		return nil, err
+	}
+	proxyFn, err := proxyFunc(proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := pooledTransport(pool)
+	transport.Proxy = proxyFn
+	transport.TLSClientConfig = config
+	return transport, nil
+}
+
+// defaultTransport is shared by the clients of configurations that were not
+// built by `ParseConfiguration`.
+var defaultTransport = pooledTransport(HTTPConfig{})
+
+// newClient returns a client that uses the given transport, or the default
+// one if nil.
+func newClient(timeout time.Duration, transport *http.Transport) *http.Client {
+	if transport == nil {
+		return &http.Client{Timeout: timeout, Transport: defaultTransport}
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// httpClient returns the client to be used for requests that are not
+// performed against an OBS server (e.g. Docker Hub or other triggers).
+func (cfg *Configuration) httpClient() *http.Client {
+	if cfg.client == nil {
+		return newClient(requestTimeout, nil)
+	}
+	return cfg.client
+}
+
+// idleCloser is implemented by triggers that keep their own connections
+// instead of using the clients of the configuration.
+type idleCloser interface {
+	closeIdleConnections()
+}
+
+// closeIdleConnections closes the idle connections of all the clients of the
+// given configuration, including the ones of its triggers.
+func (cfg *Configuration) closeIdleConnections() {
+	for _, list := range cfg.Listeners {
+		if closer, ok := list.trigger.(idleCloser); ok {
+			closer.closeIdleConnections()
+		}
+	}
+
+	clients := []*http.Client{cfg.client, cfg.obsClient}
+	for _, srv := range cfg.Servers {
+		clients = append(clients, srv.client)
+	}
+	for _, client := range clients {
+		if client == nil {
+			continue
+		}
+		if transport, ok := client.Transport.(*http.Transport); ok && transport != defaultTransport {
+			transport.CloseIdleConnections()
+		}
+	}
+}
+
+// closeBody drains and closes the body of the given response, so the
+// connection can be reused.
+func closeBody(resp *http.Response) {
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDrain))
+	resp.Body.Close()
+}
@@ -0,0 +1,427 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writePEM writes the given DER data as a PEM file with the given name inside
+// of dir, and returns its path.
+func writePEM(t *testing.T, dir, name, kind string, der []byte) string {
+	path := filepath.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Could not write %v: %v", path, err)
+	}
+	return path
+}
+
+// writeClientCertificate writes a self-signed client certificate and its key
+// into dir, and returns their paths.
+func writeClientCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "openhub"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not marshal key: %v", err)
+	}
+	return writePEM(t, dir, "client.crt", "CERTIFICATE", der),
+		writePEM(t, dir, "client.key", "EC PRIVATE KEY", keyDER)
+}
+
+// transportOf returns the transport of the given client.
+func transportOf(t *testing.T, client *http.Client) *http.Transport {
+	if client == nil {
+		t.Fatalf("Expecting a client")
+	}
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Expecting an HTTP transport, got %T", client.Transport)
+	}
+	return transport
+}
+
+// tlsRequest performs a request to the given OBS server with a transport
+// built from the given settings.
+func tlsRequest(t *testing.T, url string, tlsCfg TLSConfig, proxy string) error {
+	cfg := testShutdownConfiguration(url, 0)
+	transport, err := newTransport(tlsCfg, proxy, HTTPConfig{})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	cfg.obsClient = newClient(requestTimeout, transport)
+
+	resp, err := request(context.Background(), cfg, cfg.Listeners[0], "GET", "/build/Devel:Portus/_status")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting a 200 status code, got %v", resp.StatusCode)
+	}
+	return nil
+}
+
+func TestTransportCA(t *testing.T) {
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+	server := httptest.NewTLSServer(obs.Config.Handler)
+	defer server.Close()
+
+	if err := tlsRequest(t, server.URL, TLSConfig{}, ""); err == nil {
+		t.Fatalf("Expecting the certificate of the server to be rejected")
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := writePEM(t, dir, "ca.crt", "CERTIFICATE", server.Certificate().Raw)
+	if err := tlsRequest(t, server.URL, TLSConfig{CA: ca}, ""); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := tlsRequest(t, server.URL, TLSConfig{InsecureSkipVerify: true}, ""); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+}
+
+func TestTransportMinVersion(t *testing.T) {
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+	server := httptest.NewUnstartedServer(obs.Config.Handler)
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+
+	tlsCfg := TLSConfig{MinVersion: "1.2", InsecureSkipVerify: true}
+	if err := tlsRequest(t, server.URL, tlsCfg, ""); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	tlsCfg.MinVersion = "1.3"
+	if err := tlsRequest(t, server.URL, tlsCfg, ""); err == nil {
+		t.Fatalf("Expecting the handshake to fail")
+	}
+}
+
+func TestTransportClientCertificate(t *testing.T) {
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+	server := httptest.NewUnstartedServer(obs.Config.Handler)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	tlsCfg := TLSConfig{InsecureSkipVerify: true}
+	if err := tlsRequest(t, server.URL, tlsCfg, ""); err == nil {
+		t.Fatalf("Expecting the server to require a client certificate")
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	tlsCfg.Cert, tlsCfg.Key = writeClientCertificate(t, dir)
+	if err := tlsRequest(t, server.URL, tlsCfg, ""); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+}
+
+func TestTransportProxy(t *testing.T) {
+	var mutex sync.Mutex
+	hosts := []string{}
+
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		hosts = append(hosts, r.URL.Host)
+		mutex.Unlock()
+
+		r.URL.Scheme, r.URL.Host = "", ""
+		obs.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	if err := tlsRequest(t, "http://obs.example.com", TLSConfig{}, proxy.URL); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assertSlice(t, []string{"obs.example.com"}, hosts)
+}
+
+func TestNewTransport(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	bad := filepath.Join(dir, "bad.crt")
+	if err := ioutil.WriteFile(bad, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("Could not write %v: %v", bad, err)
+	}
+
+	for _, c := range []struct {
+		tls   TLSConfig
+		proxy string
+		err   string
+	}{
+		{TLSConfig{MinVersion: "1.4"}, "", "unknown TLS version '1.4'"},
+		{TLSConfig{CA: bad}, "", "no certificates found in '" + bad + "'"},
+		{TLSConfig{Cert: bad}, "", "both the client certificate and its key have to be given"},
+		{TLSConfig{}, "ftp://proxy", "bad proxy 'ftp://proxy': unsupported scheme 'ftp'"},
+		{TLSConfig{}, "http://%zz", "bad proxy 'http://%zz'"},
+	} {
+		_, err := newTransport(c.tls, c.proxy, HTTPConfig{})
+		if err == nil {
+			t.Fatalf("Expecting errors for %v", c)
+		}
+		if !strings.HasPrefix(err.Error(), c.err) {
+			t.Fatalf("Expecting error '%v', got '%v'", c.err, err)
+		}
+	}
+
+	transport, err := newTransport(TLSConfig{}, ProxyDirect, HTTPConfig{})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if transport.Proxy != nil {
+		t.Fatalf("Expecting no proxy to be used")
+	}
+}
+
+func TestParseConfigurationTransport(t *testing.T) {
+	cfg, err := ParseConfiguration(getPath("test/tls.yml"), Credentials{}, Options{})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	transport := transportOf(t, cfg.obsClient)
+	if transport.Proxy == nil {
+		t.Fatalf("Expecting the global server to use the given proxy")
+	}
+	req, _ := http.NewRequest("GET", "https://api.opensuse.org", nil)
+	u, _ := transport.Proxy(req)
+	assertString(t, "http://proxy.example.com:3128", u.String())
+
+	transport = transportOf(t, cfg.Servers["internal"].client)
+	if transport.Proxy != nil {
+		t.Fatalf("Expecting the internal server not to use any proxy")
+	}
+	if transport.TLSClientConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("Expecting TLS 1.2 as the minimum version")
+	}
+	if !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Fatalf("Expecting the verification to be skipped")
+	}
+
+	transport = transportOf(t, cfg.client)
+	u, _ = transport.Proxy(req)
+	assertString(t, "http://triggers.example.com:3128", u.String())
+	if transport.TLSClientConfig.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("Expecting TLS 1.3 as the minimum version for triggers")
+	}
+
+	_, err = sanitizeServers(ConfigFile{Servers: map[string]OBSServer{
+		"obs": {URL: "https://obs", TLS: TLSConfig{MinVersion: "2"}},
+	}}, Credentials{})
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "obs server: unknown TLS version '2'", err.Error())
+}
+
+func TestTriggersTransportCA(t *testing.T) {
+	server, _ := testWebhook(http.StatusOK)
+	defer server.Close()
+	secure := httptest.NewTLSServer(server.Config.Handler)
+	defer secure.Close()
+
+	trigger, err := newWebhookTrigger(&Configuration{}, Listener{Name: "portus-head"}, webhookConfig(secure.URL, "{{.Tag}}"))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if trigger.Fire(context.Background(), testEvent) == nil {
+		t.Fatalf("Expecting the certificate of the webhook to be rejected")
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := writePEM(t, dir, "ca.crt", "CERTIFICATE", secure.Certificate().Raw)
+	transport, err := newTransport(TLSConfig{CA: ca}, "", HTTPConfig{})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	cfg := &Configuration{client: newClient(requestTimeout, transport)}
+
+	trigger, err = newWebhookTrigger(cfg, Listener{Name: "portus-head"}, webhookConfig(secure.URL, "{{.Tag}}"))
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	if err := trigger.Fire(context.Background(), testEvent); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+}
+
+// countingServer starts a server with the given handler which counts the
+// connections that were opened and closed.
+func countingServer(handler http.Handler) (*httptest.Server, func() (int, int)) {
+	var mutex sync.Mutex
+	opened, closed := 0, 0
+
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch state {
+		case http.StateNew:
+			opened++
+		case http.StateClosed, http.StateHijacked:
+			closed++
+		}
+	}
+	server.Start()
+
+	return server, func() (int, int) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return opened, closed
+	}
+}
+
+func TestConnectionsAreReused(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	handler := testOBS(&testOptions{})
+	handler.Close()
+	obs, obsConns := countingServer(handler.Config.Handler)
+	defer obs.Close()
+
+	opts := &testOptions{}
+	handler = testHub(opts)
+	handler.Close()
+	hub, hubConns := countingServer(handler.Config.Handler)
+	defer hub.Close()
+	dockerHub = hub.URL + "/"
+
+	cfg, err := ParseConfiguration(
+		getPath("test/http.yml"),
+		Credentials{Server: obs.URL, User: "user", Password: "password", Token: "token"},
+		Options{},
+	)
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	const cycles = 25
+	for i := 0; i < cycles; i++ {
+		st := &state{
+			revisions: make(map[string]string),
+			store:     &memoryStore{},
+			seen:      make(map[string]bool),
+			triggers:  context.Background(),
+		}
+		performSync(context.Background(), cfg, st, cfg.Listeners)
+	}
+	if n := strings.Count(opts.pushed(), "-"); n != 2*cycles {
+		t.Fatalf("Expecting %v tags to be pushed, got %v: %v", 2*cycles, n, buf.String())
+	}
+
+	if opened, _ := obsConns(); opened != 1 {
+		t.Fatalf("Expecting a single connection to OBS, got %v", opened)
+	}
+	if opened, _ := hubConns(); opened != 1 {
+		t.Fatalf("Expecting a single connection to Docker Hub, got %v", opened)
+	}
+
+	// Idle connections are closed when the configuration is replaced.
+	cfg.closeIdleConnections()
+	for i := 0; i < 100; i++ {
+		_, obsClosed := obsConns()
+		_, hubClosed := hubConns()
+		if obsClosed == 1 && hubClosed == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expecting idle connections to be closed")
+}
+
+func TestParseConfigurationHTTP(t *testing.T) {
+	cfg, err := ParseConfiguration(getPath("test/http.yml"), Credentials{}, Options{})
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	for _, client := range []*http.Client{cfg.client, cfg.obsClient} {
+		transport := transportOf(t, client)
+		got := []int{transport.MaxIdleConns, transport.MaxIdleConnsPerHost, int(transport.IdleConnTimeout)}
+		if exp := []int{20, 4, int(30 * time.Second)}; !reflect.DeepEqual(exp, got) {
+			t.Fatalf("Expecting pool settings %v, got %v", exp, got)
+		}
+	}
+
+	transport := pooledTransport(HTTPConfig{})
+	if transport.MaxIdleConnsPerHost != defaultMaxIdleConnsPerHost {
+		t.Fatalf("Expecting the default pool settings")
+	}
+
+	for _, c := range []struct {
+		http HTTPConfig
+		err  string
+	}{
+		{HTTPConfig{MaxIdleConns: -1}, "the maximum of idle connections cannot be negative"},
+		{HTTPConfig{MaxIdleConnsPerHost: -1}, "the maximum of idle connections cannot be negative"},
+		{HTTPConfig{IdleConnTimeout: -time.Second}, "the idle connection timeout cannot be negative"},
+	} {
+		err := c.http.validate()
+		if err == nil {
+			t.Fatalf("Expecting errors for %v", c.http)
+		}
+		assertString(t, c.err, err.Error())
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultTrigger is the type of trigger to be used if a listener does not
+// specify one.
+const defaultTrigger = "dockerhub"
+
+// Event describes a new revision of a listener. It is the data given to
+// triggers.
+type Event struct {
+	Name         string
+	Project      string
+	Package      string
+	Distribution string
+	Architecture string
+	Repository   string
+	Revision     string
+	Tags         []string
+}
+
+// newEvent returns the event for the given listener and revision.
+func newEvent(list Listener, rev string) Event {
+	return Event{
+		Name:         list.Name,
+		Project:      list.Project,
+		Package:      list.Package,
+		Distribution: list.Distribution,
+		Architecture: list.Architecture,
+		Repository:   list.Repository,
+		Revision:     rev,
+		Tags:         list.Tags,
+	}
+}
+
+// eventVariables returns the data of the given event for the given tag as
+// `OPENHUB_*` variables.
+func eventVariables(ev Event, tag string) map[string]string {
+	return map[string]string{
+		"OPENHUB_NAME":         ev.Name,
+		"OPENHUB_PROJECT":      ev.Project,
+		"OPENHUB_PACKAGE":      ev.Package,
+		"OPENHUB_DISTRIBUTION": ev.Distribution,
+		"OPENHUB_ARCHITECTURE": ev.Architecture,
+		"OPENHUB_REVISION":     ev.Revision,
+		"OPENHUB_TAG":          tag,
+	}
+}
+
+// Trigger is the interface to be implemented by build-system backends.
+type Trigger interface {
+	// Fire triggers the builds for all the tags of the given event. It
+	// returns an error if any of them could not be triggered.
+	Fire(ctx context.Context, ev Event) error
+
+	// Describe returns a description of each action that Fire would perform
+	// for the given event, with secrets redacted. It is used on dry runs.
+	Describe(ev Event) []string
+
+	// String returns the target of this trigger, as shown in logs.
+	String() string
+}
+
+// triggerFactory returns a new trigger for the given listener.
+type triggerFactory func(cfg *Configuration, list Listener, tc TriggerConfig) (Trigger, error)
+
+// triggerFactories contains the factory for each supported type of trigger.
+var triggerFactories = map[string]triggerFactory{
+	"command":   newCommandTrigger,
+	"dockerhub": newDockerHubTrigger,
+	"engine":    newEngineTrigger,
+	"github":    newGitHubTrigger,
+	"gitlab":    newGitLabTrigger,
+	"quay":      newQuayTrigger,
+	"webhook":   newWebhookTrigger,
+}
+
+// newTrigger returns the trigger as configured for the given listener.
+func newTrigger(cfg *Configuration, list Listener) (Trigger, error) {
+	kind := list.Trigger.Type
+	if kind == "" {
+		kind = defaultTrigger
+	}
+
+	factory, ok := triggerFactories[kind]
+	if !ok {
+		return nil, fmt.Errorf("%v service has an unknown trigger type '%v'!", list.Name, kind)
+	}
+	return factory(cfg, list, list.Trigger)
+}
+
+// triggerFor returns the trigger of the given listener, creating it if needed.
+func triggerFor(cfg *Configuration, list Listener) (Trigger, error) {
+	if list.trigger != nil {
+		return list.trigger, nil
+	}
+	return newTrigger(cfg, list)
+}
+
+// TriggerConfig is the configuration of the trigger of a listener. Besides the
+// type of trigger, it contains the options for it, which are only interpreted
+// by the trigger itself.
+type TriggerConfig struct {
+	Type    string
+	Options map[string]interface{}
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (tc *TriggerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	opts := map[string]interface{}{}
+	if err := unmarshal(&opts); err != nil {
+		return err
+	}
+
+	if kind, ok := opts["type"]; ok {
+		tc.Type = fmt.Sprintf("%v", kind)
+		delete(opts, "type")
+	}
+	tc.Options = opts
+	return nil
+}
+
+// decode decodes the options of this trigger into the given struct. It
+// returns an error if there are options that are not known by the struct.
+func (tc TriggerConfig) decode(out interface{}) error {
+	known := map[string]bool{}
+	typ := reflect.TypeOf(out).Elem()
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("yaml"), ",")[0]
+		if name != "" && name != "-" {
+			known[name] = true
+		}
+	}
+
+	unknown := []string{}
+	for k := range tc.Options {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown options for the '%v' trigger: %v", tc.Type, strings.Join(unknown, ", "))
+	}
+
+	data, err := yaml.Marshal(tc.Options)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, out)
+}
@@ -0,0 +1,219 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingTrigger is a trigger that records the events it has been fired for.
+type recordingTrigger struct {
+	mutex  sync.Mutex
+	fail   bool
+	events []Event
+}
+
+func (t *recordingTrigger) Fire(ctx context.Context, ev Event) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.fail {
+		return errors.New("recording trigger failed")
+	}
+	t.events = append(t.events, ev)
+	return nil
+}
+
+func (t *recordingTrigger) Describe(ev Event) []string {
+	return []string{"record " + ev.Revision}
+}
+
+func (t *recordingTrigger) String() string {
+	return "recording trigger"
+}
+
+func (t *recordingTrigger) fired() []Event {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]Event{}, t.events...)
+}
+
+func TestParseConfigurationTrigger(t *testing.T) {
+	cfg, err := ParseConfiguration(
+		getPath("test/trigger.yml"),
+		Credentials{Server: "https://api.opensuse.org", Token: "token"},
+		Options{},
+	)
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	hub, ok := findListener(t, cfg.Listeners, "portus-head").trigger.(*dockerHubTrigger)
+	if !ok {
+		t.Fatalf("Expecting a Docker Hub trigger")
+	}
+	assertString(t, "opensuse/portus-head", hub.repository)
+	assertString(t, "head-token", hub.token)
+
+	// Without options, Docker Hub is used with the repository of the service
+	// and the global token.
+	hub, ok = findListener(t, cfg.Listeners, "portus-2.3").trigger.(*dockerHubTrigger)
+	if !ok {
+		t.Fatalf("Expecting a Docker Hub trigger")
+	}
+	assertString(t, "opensuse/portus", hub.repository)
+	assertString(t, "token", hub.token)
+}
+
+func TestParseConfigurationUnknownTrigger(t *testing.T) {
+	_, err := ParseConfiguration(
+		getPath("test/badtrigger.yml"),
+		Credentials{Server: "https://api.opensuse.org"},
+		Options{},
+	)
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	if !strings.Contains(err.Error(), "portus-head service has an unknown trigger type 'whatever'!") {
+		t.Fatalf("Wrong error: %v", err)
+	}
+}
+
+func TestTriggerConfigUnknownOptions(t *testing.T) {
+	tc := TriggerConfig{
+		Type:    "dockerhub",
+		Options: map[string]interface{}{"repository": "a/b", "tokn": "x", "other": 1},
+	}
+	_, err := newDockerHubTrigger(&Configuration{}, Listener{Name: "portus"}, tc)
+	if err == nil {
+		t.Fatalf("Expecting errors")
+	}
+	assertString(t, "portus service: unknown options for the 'dockerhub' trigger: other, tokn", err.Error())
+}
+
+func TestSyncRecordingTrigger(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+
+	cfg := testShutdownConfiguration(obs.URL, 0)
+	cfg.SingleShot = true
+	trigger := &recordingTrigger{}
+	cfg.Listeners[0].trigger = trigger
+
+	if err := Sync(context.Background(), cfg, nil); err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+
+	events := trigger.fired()
+	if len(events) != 1 {
+		t.Fatalf("Expecting one event, got %v", len(events))
+	}
+	assertString(t, "portus-2.3", events[0].Name)
+	assertString(t, "1234", events[0].Revision)
+	assertSlice(t, []string{"2.3", "latest"}, events[0].Tags)
+
+	msg := "Updated to revision '1234' the tags: '2.3', 'latest'; for recording trigger"
+	if !strings.Contains(buf.String(), msg) {
+		t.Fatalf("Wrong log")
+	}
+}
+
+func TestSyncRecordingTriggerFails(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	obs := testOBS(&testOptions{})
+	defer obs.Close()
+
+	cfg := testShutdownConfiguration(obs.URL, 0)
+	trigger := &recordingTrigger{fail: true}
+	cfg.Listeners[0].trigger = trigger
+
+	st := &state{
+		revisions: make(map[string]string),
+		store:     &memoryStore{},
+		seen:      make(map[string]bool),
+		triggers:  context.Background(),
+	}
+	synchronize(context.Background(), cfg, cfg.Listeners[0], st)
+
+	if _, ok := st.revision("portus-2.3"); ok {
+		t.Fatalf("The revision should not be recorded when the trigger fails")
+	}
+	if !strings.Contains(buf.String(), "portus-2.3: recording trigger failed") {
+		t.Fatalf("Wrong log")
+	}
+}
+
+// triggerConfig returns the configuration of a trigger of the given type, with
+// the given default options replaced by the given overrides.
+func triggerConfig(kind string, defaults, overrides map[string]interface{}) TriggerConfig {
+	opts := map[string]interface{}{}
+	for k, v := range defaults {
+		opts[k] = v
+	}
+	for k, v := range overrides {
+		opts[k] = v
+	}
+	return TriggerConfig{Type: kind, Options: opts}
+}
+
+// badTriggerConfiguration contains options that have to be rejected with the
+// given error.
+type badTriggerConfiguration struct {
+	options map[string]interface{}
+	err     string
+}
+
+// testBadTriggerConfiguration checks that the given factory rejects each of
+// the given cases for the given listener. The options of each case replace
+// the given defaults.
+func testBadTriggerConfiguration(t *testing.T, factory triggerFactory, list Listener, kind string,
+	defaults map[string]interface{}, cases []badTriggerConfiguration) {
+
+	for _, c := range cases {
+		_, err := factory(&Configuration{}, list, triggerConfig(kind, defaults, c.options))
+		if err == nil {
+			t.Fatalf("Expecting errors for %v", c.options)
+		}
+		assertString(t, c.err, err.Error())
+	}
+}
+
+// testTriggerDescribe checks the description of the given event by the
+// trigger built from the given factory, and returns the trigger.
+func testTriggerDescribe(t *testing.T, factory triggerFactory, list Listener, tc TriggerConfig,
+	ev Event, expected []string) Trigger {
+
+	trigger, err := factory(&Configuration{}, list, tc)
+	if err != nil {
+		t.Fatalf("Expecting no errors, got: %v", err)
+	}
+	assertSlice(t, expected, trigger.Describe(ev))
+	return trigger
+}
@@ -0,0 +1,163 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// webhookData is the data available to the body template of webhooks.
+type webhookData struct {
+	Event
+	Tag string
+}
+
+// webhookTrigger sends an HTTP request for each tag to an arbitrary URL.
+type webhookTrigger struct {
+	url     string
+	host    string
+	method  string
+	headers map[string]string
+	body    *template.Template
+	policy  RetryPolicy
+	client  *http.Client
+}
+
+// newWebhookTrigger returns a webhook trigger for the given listener.
+func newWebhookTrigger(cfg *Configuration, list Listener, tc TriggerConfig) (Trigger, error) {
+	opts := struct {
+		URL     string            `yaml:"url"`
+		Method  string            `yaml:"method"`
+		Headers map[string]string `yaml:"headers"`
+		Body    string            `yaml:"body"`
+	}{}
+	if err := tc.decode(&opts); err != nil {
+		return nil, fmt.Errorf("%v service: %v", list.Name, err)
+	}
+
+	if opts.URL == "" {
+		return nil, fmt.Errorf("%v service does not provide a webhook url!", list.Name)
+	}
+	u, err := url.Parse(opts.URL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("%v service has a bad webhook url!", list.Name)
+	}
+	if opts.Method == "" {
+		opts.Method = "POST"
+	}
+
+	body, err := template.New(list.Name).Option("missingkey=error").Parse(opts.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%v service has a bad webhook body: %v", list.Name, err)
+	}
+	// Catch references to unknown fields now rather than on each trigger.
+	if err := body.Execute(&bytes.Buffer{}, webhookData{}); err != nil {
+		return nil, fmt.Errorf("%v service has a bad webhook body: %v", list.Name, err)
+	}
+
+	return &webhookTrigger{
+		url:     opts.URL,
+		host:    u.Scheme + "://" + u.Host,
+		method:  strings.ToUpper(opts.Method),
+		headers: opts.Headers,
+		body:    body,
+		policy:  cfg.Retry,
+		client:  cfg.httpClient(),
+	}, nil
+}
+
+// newRequest returns the request to be sent for the given event and tag.
+func (t *webhookTrigger) newRequest(ev Event, tag string) (*http.Request, error) {
+	var body bytes.Buffer
+	if err := t.body.Execute(&body, webhookData{Event: ev, Tag: tag}); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(t.method, t.url, &body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// Fire implements the Trigger interface.
+func (t *webhookTrigger) Fire(ctx context.Context, ev Event) error {
+	for _, tag := range ev.Tags {
+		tag := tag
+		what := "tag '" + tag + "' on the webhook"
+		err := sendTrigger(ctx, t.client, t.policy, what, func() (*http.Request, error) {
+			return t.newRequest(ev, tag)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describe implements the Trigger interface.
+func (t *webhookTrigger) Describe(ev Event) []string {
+	res := []string{}
+	for _, tag := range ev.Tags {
+		req, err := t.newRequest(ev, tag)
+		if err != nil {
+			res = append(res, "error: "+err.Error())
+			continue
+		}
+		res = append(res, describeRequest(req, t.secrets()...))
+	}
+	return res
+}
+
+// secrets returns the values of the headers that look like credentials.
+func (t *webhookTrigger) secrets() []string {
+	res := []string{}
+	for k, v := range t.headers {
+		if sensitiveHeader(k) {
+			res = append(res, v)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// String implements the Trigger interface. Only the host of the webhook is
+// shown, since its path or its query may contain credentials.
+func (t *webhookTrigger) String() string {
+	return "webhook '" + t.host + "'"
+}
+
+// sensitiveHeader returns true if the given header is likely to contain
+// credentials.
+func sensitiveHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"authorization", "token", "secret", "key", "password"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -16,7 +16,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/mssola/openhub/lib"
 
@@ -26,10 +32,70 @@ import (
 func fetchCredentials(ctx *cli.Context) lib.Credentials {
 	return lib.Credentials{
 		Server:   ctx.String("server"),
-		User:     ctx.String("user"),
-		Password: ctx.String("password"),
-		Token:    ctx.String("token"),
+		User:     fetchSecret(ctx, "user", "OPENHUB_OBS_USER"),
+		Password: fetchSecret(ctx, "password", "OPENHUB_OBS_PASSWORD"),
+		Token:    fetchSecret(ctx, "token", "OPENHUB_DOCKER_TOKEN"),
+		Auth: lib.AuthConfig{
+			Type:   ctx.String("auth"),
+			Token:  fetchSecret(ctx, "obs-token", "OPENHUB_OBS_TOKEN"),
+			SSHKey: ctx.String("ssh-key"),
+		},
+		Oscrc: ctx.String("oscrc"),
+	}
+}
+
+// fetchSecret returns the value of the given flag. If it was not given, then
+// the file pointed by the `_FILE` variant of its environment variable is used
+// (e.g. for Docker secrets). This file is read each time the configuration is
+// loaded.
+func fetchSecret(ctx *cli.Context, name, env string) string {
+	if value := ctx.String(name); value != "" {
+		return value
+	}
+	if path := os.Getenv(env + "_FILE"); path != "" {
+		return lib.SecretFile + path
+	}
+	return ""
+}
+
+func fetchOptions(ctx *cli.Context) lib.Options {
+	opts := lib.Options{
+		SingleShot:  ctx.Bool("single-shot"),
+		DryRun:      ctx.Bool("dry-run"),
+		StatePath:   ctx.String("state"),
+		StateFormat: ctx.String("state-format"),
+		GracePeriod: ctx.Duration("grace-period"),
+	}
+
+	// Only override values from the configuration file if they were
+	// explicitly given.
+	if ctx.IsSet("interval") {
+		opts.Interval = ctx.Duration("interval")
+	}
+	if ctx.IsSet("workers") {
+		opts.Workers = ctx.Int("workers")
 	}
+	return opts
+}
+
+// signalContext returns a context that is canceled when either SIGTERM or
+// SIGINT are received. After that, a second signal will terminate the program
+// right away.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %v, shutting down...", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
 }
 
 func run(ctx *cli.Context) error {
@@ -37,15 +103,22 @@ func run(ctx *cli.Context) error {
 		return fmt.Errorf("Exactly one argument is required, but %v was given", len(ctx.Args()))
 	}
 
-	cfg, err := lib.ParseConfiguration(
-		ctx.Args().First(),
-		fetchCredentials(ctx),
-		lib.Options{SingleShot: ctx.Bool("single-shot")},
-	)
+	path := ctx.Args().First()
+	load := func() (*lib.Configuration, error) {
+		return lib.ParseConfiguration(path, fetchCredentials(ctx), fetchOptions(ctx))
+	}
+	cfg, err := load()
 	if err != nil {
 		return err
 	}
-	err = lib.Sync(cfg)
+
+	sctx, cancel := signalContext()
+	defer cancel()
+
+	err = lib.Sync(sctx, cfg, reloads(sctx, path, ctx.Duration("watch"), load))
+	if err == lib.ErrGracePeriodExceeded {
+		return cli.NewExitError(err.Error(), 2)
+	}
 	return err
 }
 
@@ -74,6 +147,26 @@ func main() {
 			Usage:  "The password for the Open Build Service",
 			EnvVar: "OPENHUB_OBS_PASSWORD",
 		},
+		cli.StringFlag{
+			Name:   "oscrc",
+			Usage:  "Read the user and the password for the server from the given osc configuration file",
+			EnvVar: "OPENHUB_OSCRC",
+		},
+		cli.StringFlag{
+			Name:   "auth",
+			Usage:  "The authentication method for the Open Build Service: 'basic', 'token' or 'signature'",
+			EnvVar: "OPENHUB_OBS_AUTH",
+		},
+		cli.StringFlag{
+			Name:   "obs-token",
+			Usage:  "The API token for the Open Build Service, used by the 'token' authentication",
+			EnvVar: "OPENHUB_OBS_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "ssh-key",
+			Usage:  "The private SSH key used by the 'signature' authentication",
+			EnvVar: "OPENHUB_OBS_SSH_KEY",
+		},
 		cli.StringFlag{
 			Name:   "token, t",
 			Usage:  "The authentication token provided from DockerHub",
@@ -89,6 +182,45 @@ func main() {
 			Usage:  "Only run the execution cycle once",
 			EnvVar: "OPENHUB_SINGLE_SHOT",
 		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			Usage:  "Report what would be triggered without actually triggering anything",
+			EnvVar: "OPENHUB_DRY_RUN",
+		},
+		cli.DurationFlag{
+			Name:   "interval, i",
+			Usage:  "How often services are checked, unless a service sets its own interval",
+			Value:  5 * time.Minute,
+			EnvVar: "OPENHUB_INTERVAL",
+		},
+		cli.IntFlag{
+			Name:   "workers, w",
+			Usage:  "Maximum number of services being checked at the same time",
+			Value:  8,
+			EnvVar: "OPENHUB_WORKERS",
+		},
+		cli.DurationFlag{
+			Name:   "grace-period",
+			Usage:  "How long to wait for running triggers when shutting down",
+			Value:  30 * time.Second,
+			EnvVar: "OPENHUB_GRACE_PERIOD",
+		},
+		cli.DurationFlag{
+			Name:   "watch",
+			Usage:  "Check the configuration file for changes with the given interval (disabled by default)",
+			EnvVar: "OPENHUB_WATCH",
+		},
+		cli.StringFlag{
+			Name:   "state",
+			Usage:  "Path to the file where the last triggered revisions are persisted",
+			EnvVar: "OPENHUB_STATE",
+		},
+		cli.StringFlag{
+			Name:   "state-format",
+			Usage:  "The format of the state file: 'json' or 'kv'",
+			Value:  "json",
+			EnvVar: "OPENHUB_STATE_FORMAT",
+		},
 	}
 
 	app.Action = run
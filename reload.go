@@ -0,0 +1,89 @@
+// Copyright (C) 2018 Miquel Sabaté Solà <mikisabate@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mssola/openhub/lib"
+)
+
+// fileVersion returns a string that changes whenever the given file is
+// modified.
+func fileVersion(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%v-%v", info.ModTime().UnixNano(), info.Size())
+}
+
+// reloads returns a channel that gets a new configuration each time that
+// SIGHUP is received or, if `watch` is not zero, each time the given file is
+// modified. Configurations are obtained through the given `load` function, and
+// the ones that could not be loaded are skipped.
+func reloads(ctx context.Context, path string, watch time.Duration,
+	load func() (*lib.Configuration, error)) <-chan *lib.Configuration {
+
+	res := make(chan *lib.Configuration)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hup)
+
+		var ticks <-chan time.Time
+		if watch > 0 {
+			ticker := time.NewTicker(watch)
+			defer ticker.Stop()
+			ticks = ticker.C
+		}
+		last := fileVersion(path)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				log.Printf("Received SIGHUP, reloading the configuration...")
+			case <-ticks:
+				if fileVersion(path) == last {
+					continue
+				}
+				log.Printf("The configuration file has changed, reloading...")
+			}
+			last = fileVersion(path)
+
+			cfg, err := load()
+			if err != nil {
+				log.Printf("Could not reload the configuration, keeping the current one: %v", err)
+				continue
+			}
+			select {
+			case res <- cfg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res
+}